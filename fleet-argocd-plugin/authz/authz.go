@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authz authorizes ApplicationSets to query fleet scopes, so that fleet team scopes act as a tenancy boundary.
+package authz
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// ErrDenied is returned when an ApplicationSet is not allowed to query a scope.
+	ErrDenied = errors.New("permission denied")
+	// ErrUnauthenticated is returned when a request does not carry the bearer token of the plugin.
+	ErrUnauthenticated = errors.New("unauthenticated")
+)
+
+// LoadToken reads the bearer token of the plugin, shared with the ApplicationSet controller, from a file, eg. a
+// mounted secret.
+func LoadToken(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", file)
+	}
+	return token, nil
+}
+
+// Authenticate returns ErrUnauthenticated unless the Authorization header is "Bearer <token>". An empty token allows
+// every request. Only the ApplicationSet controller knows the token, so the ApplicationSet names of authenticated
+// requests may be trusted by the Policy.
+func Authenticate(header, token string) error {
+	if token == "" {
+		return nil
+	}
+	got, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return fmt.Errorf("%w: missing or invalid bearer token", ErrUnauthenticated)
+	}
+	return nil
+}
+
+// Policy maps ApplicationSets to the scopes they may query. Requests matching no rule are denied.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule allows the matching ApplicationSets to query scopes.
+type Rule struct {
+	// ApplicationSets are glob patterns, as in path.Match, of the ApplicationSet names, eg. "team-a-*". Plugin
+	// requests do not carry the namespace of the ApplicationSet, so ApplicationSets of the same name in any
+	// namespace match.
+	ApplicationSets []string `json:"applicationSets"`
+	// Projects limits the rule to these fleet host project numbers, any project if empty.
+	Projects []string `json:"projects,omitempty"`
+	// Scopes are the scope IDs which may be queried, or "*" for any scope.
+	Scopes []string `json:"scopes,omitempty"`
+	// AllClusters allows querying without a scope ID, which returns every cluster of the fleet.
+	AllClusters bool `json:"allClusters,omitempty"`
+}
+
+// LoadPolicy reads and validates a YAML or JSON policy file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %w", file, err)
+	}
+	for i, r := range p.Rules {
+		if len(r.ApplicationSets) == 0 {
+			return nil, fmt.Errorf("invalid policy %s: rule %d matches no applicationSets", file, i)
+		}
+		for _, pattern := range r.ApplicationSets {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid policy %s: rule %d: pattern %q: %w", file, i, pattern, err)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Authorize returns ErrDenied unless a rule allows the ApplicationSet to query the scope of the fleet project,
+// or every cluster of the fleet if scopeID is empty. A nil Policy allows every request.
+func (p *Policy) Authorize(appSet, projectNum, scopeID string) error {
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.Rules {
+		if !r.matches(appSet, projectNum) {
+			continue
+		}
+		if scopeID == "" && r.AllClusters {
+			return nil
+		}
+		if scopeID != "" && (slices.Contains(r.Scopes, scopeID) || slices.Contains(r.Scopes, "*")) {
+			return nil
+		}
+	}
+	if scopeID == "" {
+		return fmt.Errorf("%w: ApplicationSet %q may not query all clusters of fleet %s", ErrDenied, appSet, projectNum)
+	}
+	return fmt.Errorf("%w: ApplicationSet %q may not query scope %q of fleet %s", ErrDenied, appSet, scopeID, projectNum)
+}
+
+func (r Rule) matches(appSet, projectNum string) bool {
+	if len(r.Projects) > 0 && !slices.Contains(r.Projects, projectNum) {
+		return false
+	}
+	for _, pattern := range r.ApplicationSets {
+		if ok, _ := path.Match(pattern, appSet); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package authz
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `
+rules:
+- applicationSets: ["team-a-*"]
+  scopes: ["team-a"]
+- applicationSets: ["platform"]
+  projects: ["123"]
+  scopes: ["*"]
+  allClusters: true
+`
+
+func TestAuthorize(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(file, []byte(testPolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(file)
+	if err != nil {
+		t.Fatalf("LoadPolicy() failed: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		appSet     string
+		projectNum string
+		scopeID    string
+		wantDenied bool
+	}{
+		{name: "allowed_scope", appSet: "team-a-web", projectNum: "123", scopeID: "team-a"},
+		{name: "other_scope", appSet: "team-a-web", projectNum: "123", scopeID: "team-b", wantDenied: true},
+		{name: "all_clusters_without_privilege", appSet: "team-a-web", projectNum: "123", wantDenied: true},
+		{name: "unknown_application_set", appSet: "team-b-web", projectNum: "123", scopeID: "team-a", wantDenied: true},
+		{name: "all_clusters", appSet: "platform", projectNum: "123"},
+		{name: "any_scope", appSet: "platform", projectNum: "123", scopeID: "team-b"},
+		{name: "other_project", appSet: "platform", projectNum: "456", wantDenied: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := p.Authorize(tc.appSet, tc.projectNum, tc.scopeID)
+			if denied := errors.Is(err, ErrDenied); denied != tc.wantDenied {
+				t.Errorf("Authorize() = %v, want denied %v", err, tc.wantDenied)
+			}
+		})
+	}
+
+	var nilPolicy *Policy
+	if err := nilPolicy.Authorize("any", "123", ""); err != nil {
+		t.Errorf("Authorize() without policy = %v, want nil", err)
+	}
+}
+
+func TestLoadPolicyInvalid(t *testing.T) {
+	for name, policy := range map[string]string{
+		"unknown_field":    "rules:\n- applicationSets: [a]\n  scope: [b]\n",
+		"no_app_sets":      "rules:\n- scopes: [b]\n",
+		"malformed_glob":   "rules:\n- applicationSets: [\"[\"]\n",
+		"malformed_policy": "rules: {",
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.yaml")
+			if err := os.WriteFile(file, []byte(policy), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadPolicy(file); err == nil {
+				t.Error("LoadPolicy() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		header     string
+		token      string
+		wantDenied bool
+	}{
+		{name: "valid_token", header: "Bearer secret", token: "secret"},
+		{name: "no_token_configured", header: "", token: ""},
+		{name: "missing_header", header: "", token: "secret", wantDenied: true},
+		{name: "wrong_token", header: "Bearer other", token: "secret", wantDenied: true},
+		{name: "token_prefix", header: "Bearer sec", token: "secret", wantDenied: true},
+		{name: "not_bearer", header: "Basic secret", token: "secret", wantDenied: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Authenticate(tc.header, tc.token)
+			if denied := errors.Is(err, ErrUnauthenticated); denied != tc.wantDenied {
+				t.Errorf("Authenticate() = %v, want denied %v", err, tc.wantDenied)
+			}
+		})
+	}
+}
+
+func TestLoadToken(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := LoadToken(file); err != nil || token != "secret" {
+		t.Errorf("LoadToken() = %q, %v, want secret", token, err)
+	}
+	if err := os.WriteFile(file, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadToken(file); err == nil {
+		t.Error("LoadToken() of an empty file succeeded, want error")
+	}
+}
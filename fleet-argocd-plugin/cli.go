@@ -0,0 +1,226 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fleet-management-tools/argocd-sync/fakehub"
+	"fleet-management-tools/argocd-sync/fleetclient"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	container "google.golang.org/api/container/v1"
+)
+
+const usage = `Usage: fleet-argocd-plugin [command] [flags]
+
+Without a command, serves the plugin generator configured by ENV vars.
+
+Commands:
+  render    Prints the response of the plugin to a request, from the live Fleet API or a snapshot.
+  snapshot  Saves the fleet topology of a project to a file, for offline rendering.
+
+Run "fleet-argocd-plugin [command] -h" for the flags of a command.
+`
+
+// runCommand runs a subcommand of the plugin binary, and exits on failure.
+func runCommand(name string, args []string) {
+	var err error
+	switch name {
+	case "render":
+		err = renderCommand(args, os.Stdout)
+	case "snapshot":
+		err = snapshotCommand(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal("Error running "+name, err)
+	}
+}
+
+// renderCommand prints the PluginResponse to a PluginRequest to stdout, with the plugin configured by ENV vars as
+// when serving.
+func renderCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	requestFile := fs.String("request", "", "File of the JSON PluginRequest, or - for stdin. The other flags override its fields.")
+	project := fs.String("project", "", "Fleet host project number, the fleetProjectNumber parameter.")
+	scope := fs.String("scope", "", "Scope ID, the scopeId parameter.")
+	perNamespace := fs.Bool("per-namespace", false, "Return one parameter set per fleet namespace of the scope.")
+	appSet := fs.String("appset", "", "Name of the ApplicationSet, for the authorization policy.")
+	snapshot := fs.String("snapshot", "", "Fleet snapshot file to render from, instead of the live Fleet API.")
+	_ = fs.Parse(args)
+
+	var request PluginRequest
+	if *requestFile != "" {
+		var data []byte
+		var err error
+		if *requestFile == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*requestFile)
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &request); err != nil {
+			return fmt.Errorf("invalid request %s: %w", *requestFile, err)
+		}
+	}
+	params := &request.Input.Parameters
+	if *project != "" {
+		params.FleetProjectNumber = *project
+	}
+	if *scope != "" {
+		params.ScopeID = *scope
+	}
+	if *perNamespace {
+		params.PerNamespace = true
+	}
+	if *appSet != "" {
+		request.ApplicationSetName = *appSet
+	}
+
+	opts := loadOptions()
+	// Rendering never touches the cluster secrets and AppProjects.
+	opts.DisableSecrets = true
+	opts.AppProjects = nil
+	if *snapshot != "" {
+		endpoint, err := serveSnapshot(*snapshot)
+		if err != nil {
+			return err
+		}
+		opts.Endpoint = endpoint
+		opts.ContainerEndpoint = endpoint
+	}
+	ctx := context.Background()
+	fleetSyncs = fleetclient.NewRegistry(ctx, []string{params.FleetProjectNumber}, opts)
+
+	response, err := render(ctx, request)
+	if err != nil {
+		return fmt.Errorf("HTTP %d: %w", httpStatus(err), err)
+	}
+	out, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, string(out))
+	return err
+}
+
+// serveSnapshot serves the fleet snapshot file with a local fake GKE Hub server, and returns its endpoint.
+func serveSnapshot(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var f fakehub.Fleet
+	if err := json.Unmarshal(data, &f); err != nil {
+		return "", fmt.Errorf("invalid snapshot %s: %w", file, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() { _ = http.Serve(ln, fakehub.NewServer(f, 0)) }()
+	return "http://" + ln.Addr().String() + "/", nil
+}
+
+// snapshotCommand saves the fleet topology of a project, in the format of the fake GKE Hub server.
+func snapshotCommand(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	project := fs.String("project", os.Getenv("FLEET_PROJECT_NUMBER"), "Fleet host project number.")
+	output := fs.String("o", "", "Output file, stdout if empty.")
+	dnsEndpoints := fs.Bool("dns-endpoints", false, "Also save the DNS endpoints of the GKE clusters, for the dns endpoint strategy.")
+	_ = fs.Parse(args)
+	if *project == "" {
+		return fmt.Errorf("missing -project")
+	}
+
+	ctx := context.Background()
+	backend, err := fleetclient.NewBackend(ctx, os.Getenv("FLEET_API_ENDPOINT"), os.Getenv("GKE_API_ENDPOINT"))
+	if err != nil {
+		return err
+	}
+	var f fakehub.Fleet
+	var unreachable []string
+	if f.Memberships, unreachable, err = backend.ListMemberships(ctx, *project); err != nil {
+		return fmt.Errorf("failed to list memberships: %w", err)
+	}
+	f.Unreachable = append(f.Unreachable, unreachable...)
+	if f.Scopes, err = backend.ListScopes(ctx, *project); err != nil {
+		return fmt.Errorf("failed to list scopes: %w", err)
+	}
+	for _, s := range f.Scopes {
+		namespaces, err := backend.ListScopeNamespaces(ctx, s.Name)
+		if err != nil {
+			return fmt.Errorf("failed to list namespaces of scope %s: %w", s.Name, err)
+		}
+		f.Namespaces = append(f.Namespaces, namespaces...)
+	}
+	if f.Bindings, unreachable, err = backend.ListMembershipBindings(ctx, *project); err != nil {
+		return fmt.Errorf("failed to list membership bindings: %w", err)
+	}
+	for _, u := range unreachable {
+		if !slices.Contains(f.Unreachable, u) {
+			f.Unreachable = append(f.Unreachable, u)
+		}
+	}
+	if f.Features, err = backend.ListFeatures(ctx, *project); err != nil {
+		return fmt.Errorf("failed to list features: %w", err)
+	}
+	if len(f.Unreachable) > 0 {
+		slog.Warn("The snapshot is missing unreachable locations", "locations", f.Unreachable)
+	}
+	if *dnsEndpoints {
+		f.Clusters = make(map[string]*container.Cluster)
+		for _, mem := range f.Memberships {
+			if mem.Endpoint == nil || mem.Endpoint.GkeCluster == nil {
+				continue
+			}
+			name := strings.TrimPrefix(mem.Endpoint.GkeCluster.ResourceLink, "//container.googleapis.com/")
+			ep, err := backend.GetClusterDNSEndpoint(ctx, name)
+			if err != nil {
+				return fmt.Errorf("failed to get the DNS endpoint of cluster %s: %w", name, err)
+			}
+			f.Clusters[name] = &container.Cluster{
+				ControlPlaneEndpointsConfig: &container.ControlPlaneEndpointsConfig{
+					DnsEndpointConfig: &container.DNSEndpointConfig{Endpoint: ep},
+				},
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = fmt.Println(string(data))
+		return err
+	}
+	return os.WriteFile(*output, append(data, '\n'), 0o644)
+}
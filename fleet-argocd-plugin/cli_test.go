@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderCommand(t *testing.T) {
+	requestFile := filepath.Join(t.TempDir(), "request.json")
+	request := `{"applicationSetName": "guestbook", "input": {"parameters": {"fleetProjectNumber": "123456", "scopeId": "backend"}}}`
+	if err := os.WriteFile(requestFile, []byte(request), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		args      []string
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "all_clusters",
+			args:      []string{"-project", testProject},
+			wantNames: []string{"dev-cluster", "eu-cluster", "us-cluster"},
+		},
+		{
+			name:      "scope",
+			args:      []string{"-project", testProject, "-scope", "frontend"},
+			wantNames: []string{"eu-cluster", "us-cluster"},
+		},
+		{
+			name:      "request_file",
+			args:      []string{"-request", requestFile},
+			wantNames: []string{},
+		},
+		{
+			name:      "flags_override_request_file",
+			args:      []string{"-request", requestFile, "-scope", "frontend"},
+			wantNames: []string{"eu-cluster", "us-cluster"},
+		},
+		{
+			name:    "unknown_scope",
+			args:    []string{"-project", testProject, "-scope", "unknown"},
+			wantErr: "HTTP 404",
+		},
+		{
+			name:    "missing_project",
+			args:    []string{"-scope", "frontend"},
+			wantErr: "HTTP 400",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pluginToken = ""
+			policy = nil
+			wavePolicy = nil
+			var out bytes.Buffer
+			err := renderCommand(append(tc.args, "-snapshot", "testdata/fleet.json"), &out)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("renderCommand() = %v, want %s", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderCommand() failed: %v", err)
+			}
+			var resp struct {
+				Output struct {
+					Parameters []struct {
+						NameShort string `json:"nameShort"`
+					} `json:"parameters"`
+				} `json:"output"`
+			}
+			if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+				t.Fatalf("output %q is not JSON: %v", out.String(), err)
+			}
+			names := []string{}
+			for _, p := range resp.Output.Parameters {
+				names = append(names, p.NameShort)
+			}
+			if strings.Join(names, ",") != strings.Join(tc.wantNames, ",") {
+				t.Errorf("rendered clusters = %v, want %v", names, tc.wantNames)
+			}
+		})
+	}
+}
+
+func TestRenderCommandInvalidSnapshot(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "fleet.json")
+	if err := os.WriteFile(snapshot, []byte(`{"memberships": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := renderCommand([]string{"-project", testProject, "-snapshot", snapshot}, &out); err == nil || !strings.Contains(err.Error(), "invalid snapshot") {
+		t.Errorf("renderCommand() = %v, want an invalid snapshot error", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("renderCommand() printed %q, want nothing", out.String())
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command fakehub runs a local fake GKE Hub REST server, serving a fleet topology read from a JSON file, for
+// offline runs of the fleet plugin with FLEET_API_ENDPOINT=http://localhost:8080/ and
+// GKE_API_ENDPOINT=http://localhost:8080/.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fleet-management-tools/argocd-sync/fakehub"
+	"log"
+	"net/http"
+	"os"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "Address to listen on.")
+	fleetFile := flag.String("fleet", "", "JSON file of the fleet topology, with memberships, scopes, namespaces, bindings and unreachable locations.")
+	pageSize := flag.Int("page-size", 0, "Default page size of list calls, 0 for a single page.")
+	flag.Parse()
+
+	var f fakehub.Fleet
+	if *fleetFile != "" {
+		data, err := os.ReadFile(*fleetFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &f); err != nil {
+			log.Fatalf("Error parsing %s: %v", *fleetFile, err)
+		}
+	}
+	log.Printf("Serving %d memberships, %d scopes, %d namespaces and %d bindings on %s", len(f.Memberships), len(f.Scopes), len(f.Namespaces), len(f.Bindings), *addr)
+	log.Fatal(http.ListenAndServe(*addr, fakehub.NewServer(f, *pageSize)))
+}
@@ -0,0 +1,265 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakehub is a fake GKE Hub REST server, serving the gkehub v1 list endpoints used by the fleet plugin
+// from an in-memory fleet topology, and the GKE v1 clusters get endpoint.
+package fakehub
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	container "google.golang.org/api/container/v1"
+	fleet "google.golang.org/api/gkehub/v1"
+)
+
+// Fleet is the fleet topology served by a Server.
+type Fleet struct {
+	Memberships []*fleet.Membership        `json:"memberships,omitempty"`
+	Scopes      []*fleet.Scope             `json:"scopes,omitempty"`
+	Namespaces  []*fleet.Namespace         `json:"namespaces,omitempty"`
+	Bindings    []*fleet.MembershipBinding `json:"bindings,omitempty"`
+	Features    []*fleet.Feature           `json:"features,omitempty"`
+	// Unreachable locations reported by the membership and membership binding list calls, whose resources are
+	// omitted.
+	Unreachable []string `json:"unreachable,omitempty"`
+	// Clusters are the GKE clusters served by the GKE API, by name
+	// projects/{project}/locations/{location}/clusters/{cluster}.
+	Clusters map[string]*container.Cluster `json:"clusters,omitempty"`
+}
+
+// Server is a fake GKE Hub REST server.
+type Server struct {
+	mux *http.ServeMux
+
+	mu       sync.Mutex
+	fleet    Fleet
+	pageSize int
+}
+
+// NewServer creates a Server serving the fleet topology, with pages of at most pageSize resources unless requested
+// otherwise by the client. A pageSize of zero returns all resources in one page.
+func NewServer(f Fleet, pageSize int) *Server {
+	s := &Server{
+		mux:      http.NewServeMux(),
+		fleet:    f,
+		pageSize: pageSize,
+	}
+	s.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/memberships", s.listMemberships)
+	s.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/memberships/{membership}/bindings", s.listMembershipBindings)
+	s.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/scopes", s.listScopes)
+	s.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/scopes/{scope}/namespaces", s.listScopeNamespaces)
+	s.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/features", s.listFeatures)
+	s.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/clusters/{cluster}", s.getCluster)
+	return s
+}
+
+// SetFleet replaces the fleet topology served by the Server.
+func (s *Server) SetFleet(f Fleet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fleet = f
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) snapshot() Fleet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fleet
+}
+
+func (s *Server) listMemberships(w http.ResponseWriter, r *http.Request) {
+	f := s.snapshot()
+	parent := parentOf(r, "memberships")
+	mems := filter(f.Memberships, parent, func(m *fleet.Membership) string { return m.Name })
+	mems = reachable(mems, f.Unreachable, func(m *fleet.Membership) string { return m.Name })
+	page, next, ok := s.paginate(w, r, len(mems))
+	if !ok {
+		return
+	}
+	writeJSON(w, &fleet.ListMembershipsResponse{
+		Resources:     mems[page[0]:page[1]],
+		NextPageToken: next,
+		Unreachable:   f.Unreachable,
+	})
+}
+
+func (s *Server) listMembershipBindings(w http.ResponseWriter, r *http.Request) {
+	f := s.snapshot()
+	parent := parentOf(r, "bindings")
+	mbs := filter(f.Bindings, parent, func(b *fleet.MembershipBinding) string { return b.Name })
+	mbs = reachable(mbs, f.Unreachable, func(b *fleet.MembershipBinding) string { return b.Name })
+	page, next, ok := s.paginate(w, r, len(mbs))
+	if !ok {
+		return
+	}
+	writeJSON(w, &fleet.ListMembershipBindingsResponse{
+		MembershipBindings: mbs[page[0]:page[1]],
+		NextPageToken:      next,
+		Unreachable:        f.Unreachable,
+	})
+}
+
+func (s *Server) listScopes(w http.ResponseWriter, r *http.Request) {
+	f := s.snapshot()
+	parent := parentOf(r, "scopes")
+	scopes := filter(f.Scopes, parent, func(sc *fleet.Scope) string { return sc.Name })
+	page, next, ok := s.paginate(w, r, len(scopes))
+	if !ok {
+		return
+	}
+	writeJSON(w, &fleet.ListScopesResponse{
+		Scopes:        scopes[page[0]:page[1]],
+		NextPageToken: next,
+	})
+}
+
+func (s *Server) listScopeNamespaces(w http.ResponseWriter, r *http.Request) {
+	f := s.snapshot()
+	parent := parentOf(r, "namespaces")
+	namespaces := filter(f.Namespaces, parent, func(ns *fleet.Namespace) string { return ns.Name })
+	page, next, ok := s.paginate(w, r, len(namespaces))
+	if !ok {
+		return
+	}
+	writeJSON(w, &fleet.ListScopeNamespacesResponse{
+		ScopeNamespaces: namespaces[page[0]:page[1]],
+		NextPageToken:   next,
+	})
+}
+
+func (s *Server) listFeatures(w http.ResponseWriter, r *http.Request) {
+	f := s.snapshot()
+	parent := parentOf(r, "features")
+	features := filter(f.Features, parent, func(ft *fleet.Feature) string { return ft.Name })
+	page, next, ok := s.paginate(w, r, len(features))
+	if !ok {
+		return
+	}
+	writeJSON(w, &fleet.ListFeaturesResponse{
+		Resources:     features[page[0]:page[1]],
+		NextPageToken: next,
+	})
+}
+
+func (s *Server) getCluster(w http.ResponseWriter, r *http.Request) {
+	f := s.snapshot()
+	name := strings.TrimPrefix(r.URL.Path, "/v1/")
+	c, ok := f.Clusters[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "cluster "+name+" not found")
+		return
+	}
+	writeJSON(w, c)
+}
+
+// parentOf returns the resource name segments of the collection listed by the request, eg.
+// ["projects", "123", "locations", "-", "memberships"].
+func parentOf(r *http.Request, collection string) []string {
+	var ret []string
+	for _, wildcard := range []string{"project", "location", "membership", "scope"} {
+		if v := r.PathValue(wildcard); v != "" {
+			ret = append(ret, wildcard+"s", v)
+		}
+	}
+	return append(ret, collection)
+}
+
+// filter returns the resources whose name is in the parent collection, where "-" matches any ID.
+func filter[T any](resources []T, parent []string, name func(T) string) []T {
+	ret := []T{}
+	for _, res := range resources {
+		parts := strings.Split(name(res), "/")
+		if len(parts) != len(parent)+1 {
+			continue
+		}
+		match := true
+		for i, p := range parent {
+			if p != "-" && p != parts[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			ret = append(ret, res)
+		}
+	}
+	return ret
+}
+
+// reachable returns the resources which are not in one of the unreachable locations.
+func reachable[T any](resources []T, unreachable []string, name func(T) string) []T {
+	ret := []T{}
+	for _, res := range resources {
+		if parts := strings.Split(name(res), "/"); len(parts) < 4 || !slices.Contains(unreachable, parts[3]) {
+			ret = append(ret, res)
+		}
+	}
+	return ret
+}
+
+// paginate returns the [start, end) range of the requested page among n resources, and the token of the next page.
+// It replies with an error and returns false for malformed page requests.
+func (s *Server) paginate(w http.ResponseWriter, r *http.Request, n int) ([2]int, string, bool) {
+	start := 0
+	if token := r.URL.Query().Get("pageToken"); token != "" {
+		var err error
+		if start, err = strconv.Atoi(token); err != nil || start < 0 || start > n {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid pageToken")
+			return [2]int{}, "", false
+		}
+	}
+	size := s.pageSize
+	if v := r.URL.Query().Get("pageSize"); v != "" {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil || size < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid pageSize")
+			return [2]int{}, "", false
+		}
+	}
+	end := n
+	if size > 0 && start+size < n {
+		end = start + size
+	}
+	next := ""
+	if end < n {
+		next = strconv.Itoa(end)
+	}
+	return [2]int{start, end}, next, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError replies with an error in the format of Google APIs.
+func writeError(w http.ResponseWriter, code int, status, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    code,
+			"message": message,
+			"status":  status,
+		},
+	})
+}
@@ -0,0 +1,283 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+// appProjectResource is the resource of the Argo CD AppProjects,
+// https://argo-cd.readthedocs.io/en/stable/operator-manual/declarative-setup/#projects
+var appProjectResource = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "appprojects"}
+
+// Label of the fleet scope of the AppProjects.
+const scopeLabel = "fleet.gke.io/scope"
+
+// AppProjectOptions configures the Argo CD AppProject of each fleet scope.
+type AppProjectOptions struct {
+	// SourceRepos are the source repositories allowed in the AppProject of each scope, by scope ID, eg.
+	// {"frontend": ["https://github.com/my-org/frontend"]}.
+	SourceRepos map[string][]string `json:"sourceRepos,omitempty"`
+	// DefaultSourceRepos are the source repositories of the scopes without SourceRepos. Without either, the
+	// AppProject of a scope allows no source.
+	DefaultSourceRepos []string `json:"defaultSourceRepos,omitempty"`
+}
+
+// LoadAppProjectOptions reads a YAML or JSON file of AppProjectOptions.
+func LoadAppProjectOptions(file string) (*AppProjectOptions, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var opts AppProjectOptions
+	if err := yaml.UnmarshalStrict(data, &opts); err != nil {
+		return nil, fmt.Errorf("failed to parse AppProject options %s: %w", file, err)
+	}
+	return &opts, nil
+}
+
+// sourceRepos returns the source repositories of the AppProject of the scope.
+func (o *AppProjectOptions) sourceRepos(scopeID string) []string {
+	if repos, ok := o.SourceRepos[scopeID]; ok {
+		return repos
+	}
+	return o.DefaultSourceRepos
+}
+
+// appProjectReconciler applies the AppProjects of the scopes of a fleet, diffing them against an informer cache of
+// the existing AppProjects.
+type appProjectReconciler struct {
+	*appProjectCache
+	opts  *AppProjectOptions
+	guard pruneGuard
+}
+
+// appProjectCache is an informer cache of the AppProjects, shared by the appProjectReconcilers of every fleet.
+type appProjectCache struct {
+	client dynamic.NamespaceableResourceInterface
+	lister cache.GenericNamespaceLister
+}
+
+// appProjectPruneMetrics are the pruning metrics of the AppProjects.
+var appProjectPruneMetrics = pruneMetrics{pending: pendingAppProjectPrunes, circuitOpen: appProjectPruneCircuitOpen, refused: refusedAppProjectPrunes}
+
+// newAppProjectCache creates an appProjectCache with the client, or an in-cluster client if nil, and waits for it to
+// sync. The informer runs until ctx is done.
+func newAppProjectCache(ctx context.Context, client dynamic.Interface) (*appProjectCache, error) {
+	if client == nil {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get in cluster config: %w", err)
+		}
+		if client, err = dynamic.NewForConfig(config); err != nil {
+			return nil, fmt.Errorf("failed to create Kubernetes dynamic client: %w", err)
+		}
+	}
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, argoCDNamespace, nil)
+	lister := factory.ForResource(appProjectResource).Lister()
+	factory.Start(ctx.Done())
+	for _, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return nil, fmt.Errorf("failed to sync AppProjects cache")
+		}
+	}
+	return &appProjectCache{client: client.Resource(appProjectResource), lister: lister.ByNamespace(argoCDNamespace)}, nil
+}
+
+// reconcileAppProjects applies one AppProject per scope, named {scope}.{project}, whose destinations are the fleet
+// namespaces of the scope on the clusters bound to it, and prunes those of deleted scopes.
+func (c *FleetSync) reconcileAppProjects(ctx context.Context) error {
+	if c.appProjects == nil {
+		return nil
+	}
+	appProjects := make(map[string]*unstructured.Unstructured)
+	for scopeID, memberships := range c.ScopeTenancyMapCache {
+		var servers []string
+		for _, m := range memberships {
+			if server := c.ServerURLCache[m]; server != "" {
+				servers = append(servers, server)
+			}
+		}
+		p := appProject(c.ProjectNum, scopeID, servers, c.scopeNamespaces([]string{scopeID}), c.appProjects.opts.sourceRepos(scopeID))
+		appProjects[p.GetName()] = p
+	}
+
+	applied, err := c.appProjects.apply(ctx, appProjects)
+	if err != nil {
+		return err
+	}
+	appProjectsApplied.WithLabelValues(c.ProjectNum).Add(float64(applied))
+	pruned, err := c.appProjects.prune(ctx, c.ProjectNum, appProjects)
+	if err != nil {
+		return err
+	}
+	if applied > 0 || pruned > 0 {
+		slog.Info("Reconciled AppProjects", "project", c.ProjectNum, "applied", applied, "pruned", pruned)
+	}
+	return nil
+}
+
+// appProject returns the AppProject of a scope, restricted to its fleet namespaces on the servers of its clusters and
+// to the source repositories, without cluster-scoped resources.
+func appProject(projectNum, scopeID string, servers, namespaces, sourceRepos []string) *unstructured.Unstructured {
+	sort.Strings(servers)
+	destinations := []any{}
+	for _, server := range servers {
+		for _, ns := range namespaces {
+			destinations = append(destinations, map[string]any{"server": server, "namespace": ns})
+		}
+	}
+	repos := []any{}
+	for _, r := range sourceRepos {
+		repos = append(repos, r)
+	}
+	p := &unstructured.Unstructured{Object: map[string]any{
+		"spec": map[string]any{
+			"description":  fmt.Sprintf("Fleet scope %s of project %s, managed by the fleet plugin.", scopeID, projectNum),
+			"sourceRepos":  repos,
+			"destinations": destinations,
+		},
+	}}
+	p.SetAPIVersion(appProjectResource.GroupVersion().String())
+	p.SetKind("AppProject")
+	p.SetName(fmt.Sprintf("%s.%s", scopeID, projectNum))
+	p.SetNamespace(argoCDNamespace)
+	p.SetLabels(map[string]string{scopeLabel: scopeID})
+	data, _ := json.Marshal([]any{p.GetLabels(), p.Object["spec"]})
+	p.SetAnnotations(map[string]string{
+		managedByAnnotation:   "true",
+		desiredHashAnnotation: fmt.Sprintf("%x", sha256.Sum256(data)),
+	})
+	return p
+}
+
+// appProjectChanged reports whether the actual AppProject differs from the fields of the desired one set by the
+// plugin, including changes of its spec by others.
+func appProjectChanged(actual, desired *unstructured.Unstructured) bool {
+	for k, v := range desired.GetLabels() {
+		if actual.GetLabels()[k] != v {
+			return true
+		}
+	}
+	for k, v := range desired.GetAnnotations() {
+		if actual.GetAnnotations()[k] != v {
+			return true
+		}
+	}
+	actualSpec, _ := actual.Object["spec"].(map[string]any)
+	for k, v := range desired.Object["spec"].(map[string]any) {
+		if !equality.Semantic.DeepEqual(actualSpec[k], v) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply server-side applies the desired AppProjects which differ from the cached ones, and returns how many were
+// applied.
+func (r *appProjectReconciler) apply(ctx context.Context, appProjects map[string]*unstructured.Unstructured) (int, error) {
+	names := make([]string, 0, len(appProjects))
+	for name := range appProjects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	applied := 0
+	for _, name := range names {
+		desired := appProjects[name]
+		obj, err := r.lister.Get(name)
+		if err != nil && !errors.IsNotFound(err) {
+			return applied, fmt.Errorf("error getting AppProject %s from cache: %v", name, err)
+		}
+		if actual, ok := obj.(*unstructured.Unstructured); ok && actual != nil && !appProjectChanged(actual, desired) {
+			continue
+		}
+		applyCtx, span := tracer.Start(ctx, "appprojects.Apply", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("argocd.appproject.name", name)))
+		_, err = r.client.Namespace(argoCDNamespace).Apply(applyCtx, name, desired, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+			Force:        true,
+		})
+		EndSpan(span, err)
+		if err != nil {
+			return applied, fmt.Errorf("error applying AppProject %s: %v", name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// prune deletes the cached AppProjects managed by the plugin for the fleet project which have not been desired for
+// long enough, with the safety rules of the cluster secrets, and returns how many were deleted.
+func (r *appProjectReconciler) prune(ctx context.Context, projectNum string, appProjects map[string]*unstructured.Unstructured) (int, error) {
+	existing, err := r.lister.List(labels.Everything())
+	if err != nil {
+		return 0, fmt.Errorf("failed to list AppProjects: %w", err)
+	}
+
+	managed := 0
+	var absent []string
+	for _, obj := range existing {
+		p, ok := obj.(*unstructured.Unstructured)
+		// Skip AppProjects not managed by the fleet plugin, or of other fleet host projects served by the same plugin.
+		if !ok || p.GetAnnotations()[managedByAnnotation] != "true" || !strings.HasSuffix(p.GetName(), "."+projectNum) {
+			continue
+		}
+		managed++
+		if _, exists := appProjects[p.GetName()]; !exists {
+			absent = append(absent, p.GetName())
+		}
+	}
+
+	pruned := 0
+	for _, name := range r.guard.due(projectNum, managed, absent, time.Now()) {
+		deleteCtx, span := tracer.Start(ctx, "appprojects.Delete", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("argocd.appproject.name", name)))
+		err := r.client.Namespace(argoCDNamespace).Delete(deleteCtx, name, metav1.DeleteOptions{})
+		EndSpan(span, err)
+		r.guard.pruned(name)
+		if errors.IsNotFound(err) {
+			// Already deleted, but still in the cache.
+			continue
+		}
+		if err != nil {
+			return pruned, fmt.Errorf("failed to delete AppProject: %w", err)
+		}
+		appProjectsPruned.WithLabelValues(projectNum).Inc()
+		pruned++
+	}
+	return pruned, nil
+}
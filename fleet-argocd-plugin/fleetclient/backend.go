@@ -0,0 +1,206 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	container "google.golang.org/api/container/v1"
+	fleet "google.golang.org/api/gkehub/v1"
+	"google.golang.org/api/option"
+)
+
+// Backend lists the fleet resources of a fleet host project.
+type Backend interface {
+	// ListMemberships lists the memberships of the project in all reachable locations, and the unreachable ones.
+	ListMemberships(ctx context.Context, project string) ([]*fleet.Membership, []string, error)
+	// ListScopes lists the scopes of the project.
+	ListScopes(ctx context.Context, project string) ([]*fleet.Scope, error)
+	// ListScopeNamespaces lists the fleet namespaces of a scope, given its full resource name.
+	ListScopeNamespaces(ctx context.Context, scope string) ([]*fleet.Namespace, error)
+	// ListMembershipBindings lists the membership bindings of the project in all reachable locations, and the
+	// unreachable ones.
+	ListMembershipBindings(ctx context.Context, project string) ([]*fleet.MembershipBinding, []string, error)
+	// ListFeatures lists the fleet features of the project, with their state on each membership.
+	ListFeatures(ctx context.Context, project string) ([]*fleet.Feature, error)
+	// GetClusterDNSEndpoint returns the DNS-based control plane endpoint of a GKE cluster, given its name
+	// projects/{project}/locations/{location}/clusters/{cluster}.
+	GetClusterDNSEndpoint(ctx context.Context, cluster string) (string, error)
+}
+
+// apiBackend is a Backend calling the GKE Hub and GKE APIs.
+type apiBackend struct {
+	svc       *fleet.Service
+	container *container.Service
+}
+
+// NewBackend creates a Backend calling the GKE Hub API at endpoint and the GKE API at containerEndpoint, or the
+// default endpoints if empty. Plain http endpoints, such as a local simulator, are called without authentication.
+func NewBackend(ctx context.Context, endpoint, containerEndpoint string) (Backend, error) {
+	svc, err := fleet.NewService(ctx, clientOptions(endpoint)...)
+	if err != nil {
+		return nil, err
+	}
+	containerSvc, err := container.NewService(ctx, clientOptions(containerEndpoint)...)
+	if err != nil {
+		return nil, err
+	}
+	return &apiBackend{svc: svc, container: containerSvc}, nil
+}
+
+// clientOptions returns the options of a Google API client calling endpoint, or the default endpoint if empty.
+func clientOptions(endpoint string) []option.ClientOption {
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+		if strings.HasPrefix(endpoint, "http://") {
+			opts = append(opts, option.WithoutAuthentication())
+		}
+	}
+	return opts
+}
+
+// ListMemberships fetches the memberships under a given parent.
+func (b *apiBackend) ListMemberships(ctx context.Context, project string) ([]*fleet.Membership, []string, error) {
+	var ret []*fleet.Membership
+	var unreachable []string
+	parent := fmt.Sprintf("projects/%s/locations/-", project)
+	call := b.svc.Projects.Locations.Memberships.List(parent)
+	err := listPages(ctx, "ListMemberships", func(ctx context.Context, pageToken string) (string, error) {
+		resp, err := call.PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+		// Unreachable regions (which may be transient) are reported rather than halting the refresh, so that their
+		// last-known-good memberships are kept instead of being deleted (Issue #113).
+		unreachable = appendLocations(unreachable, resp.Unreachable)
+		ret = append(ret, resp.Resources...)
+		return resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ret, unreachable, nil
+}
+
+// ListScopes fetches the scopes under a given parent.
+func (b *apiBackend) ListScopes(ctx context.Context, project string) ([]*fleet.Scope, error) {
+	var ret []*fleet.Scope
+	parent := fmt.Sprintf("projects/%s/locations/global", project)
+	call := b.svc.Projects.Locations.Scopes.List(parent)
+	err := listPages(ctx, "ListScopes", func(ctx context.Context, pageToken string) (string, error) {
+		resp, err := call.PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+		ret = append(ret, resp.Scopes...)
+		return resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ListScopeNamespaces fetches the fleet namespaces of a given scope.
+func (b *apiBackend) ListScopeNamespaces(ctx context.Context, scope string) ([]*fleet.Namespace, error) {
+	var ret []*fleet.Namespace
+	call := b.svc.Projects.Locations.Scopes.Namespaces.List(scope)
+	err := listPages(ctx, "ListScopeNamespaces", func(ctx context.Context, pageToken string) (string, error) {
+		resp, err := call.PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+		ret = append(ret, resp.ScopeNamespaces...)
+		return resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ListMembershipBindings fetches the membership bindings under a given parent.
+func (b *apiBackend) ListMembershipBindings(ctx context.Context, project string) ([]*fleet.MembershipBinding, []string, error) {
+	var ret []*fleet.MembershipBinding
+	var unreachable []string
+	parent := fmt.Sprintf("projects/%s/locations/-/memberships/-", project)
+	call := b.svc.Projects.Locations.Memberships.Bindings.List(parent)
+	err := listPages(ctx, "ListMembershipBindings", func(ctx context.Context, pageToken string) (string, error) {
+		resp, err := call.PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+		unreachable = appendLocations(unreachable, resp.Unreachable)
+		ret = append(ret, resp.MembershipBindings...)
+		return resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ret, unreachable, nil
+}
+
+// ListFeatures fetches the fleet features of a given project.
+func (b *apiBackend) ListFeatures(ctx context.Context, project string) ([]*fleet.Feature, error) {
+	var ret []*fleet.Feature
+	parent := fmt.Sprintf("projects/%s/locations/global", project)
+	call := b.svc.Projects.Locations.Features.List(parent)
+	err := listPages(ctx, "ListFeatures", func(ctx context.Context, pageToken string) (string, error) {
+		resp, err := call.PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+		ret = append(ret, resp.Resources...)
+		return resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// appendLocations appends the location IDs of the unreachable resources, eg. "projects/123/locations/us-east1" or
+// "us-east1", which are not already in locations.
+func appendLocations(locations []string, unreachable []string) []string {
+	for _, u := range unreachable {
+		loc := u[strings.LastIndex(u, "/")+1:]
+		if !slices.Contains(locations, loc) {
+			locations = append(locations, loc)
+		}
+	}
+	return locations
+}
+
+// GetClusterDNSEndpoint fetches the DNS-based control plane endpoint of a GKE cluster.
+func (b *apiBackend) GetClusterDNSEndpoint(ctx context.Context, cluster string) (string, error) {
+	ctx, span := tracer.Start(ctx, "gkeapi.GetCluster", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("gke.cluster", cluster)))
+	start := time.Now()
+	c, err := b.container.Projects.Locations.Clusters.Get(cluster).Fields("controlPlaneEndpointsConfig").Context(ctx).Do()
+	observeFleetAPI("GetCluster", start, err)
+	EndSpan(span, err)
+	if err != nil {
+		return "", err
+	}
+	if c.ControlPlaneEndpointsConfig == nil || c.ControlPlaneEndpointsConfig.DnsEndpointConfig == nil {
+		return "", nil
+	}
+	return c.ControlPlaneEndpointsConfig.DnsEndpointConfig.Endpoint, nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"text/template"
+
+	fleet "google.golang.org/api/gkehub/v1"
+)
+
+// Built-in endpoint strategies, selecting the server URL of a member cluster.
+const (
+	// ConnectGatewayEndpoint is the public regional, or global, Connect Gateway URL of the membership.
+	ConnectGatewayEndpoint = "connectgateway"
+	// DNSEndpoint is the DNS-based control plane endpoint of the GKE cluster of the membership, looked up with
+	// the GKE API. Memberships of non-GKE clusters fall back to Connect Gateway.
+	DNSEndpoint = "dns"
+)
+
+// gkeResourceLinkPrefix prefixes the resource links of GKE clusters, eg.
+// //container.googleapis.com/projects/my-project/locations/us-central1/clusters/my-cluster.
+const gkeResourceLinkPrefix = "//container.googleapis.com/"
+
+// EndpointOptions selects the endpoint strategy of each membership.
+type EndpointOptions struct {
+	// Default is the strategy of memberships without the Label, ConnectGatewayEndpoint if empty.
+	Default string
+	// Label is a membership label whose value, if set, selects the strategy of the membership.
+	Label string
+	// Templates are custom strategies by name: text/templates of the server URL, with EndpointParams, eg. to
+	// reach Connect Gateway through Private Service Connect or a custom domain.
+	Templates map[string]string
+}
+
+// EndpointParams are the parameters of custom endpoint templates.
+type EndpointParams struct {
+	// ProjectNum is the project number of the fleet host project.
+	ProjectNum   string
+	Location     string
+	MembershipID string
+	// Membership is the full fleet membership.
+	Membership *fleet.Membership
+	// ClusterProject, ClusterLocation and ClusterName identify the GKE cluster of the membership, parsed from its
+	// resource link. They are empty for non-GKE clusters.
+	ClusterProject  string
+	ClusterLocation string
+	ClusterName     string
+}
+
+// endpoints resolves the server URLs of memberships.
+type endpoints struct {
+	def       string
+	label     string
+	templates map[string]*template.Template
+	// DNS endpoints by GKE cluster name of the included memberships, only accessed by refreshes.
+	dnsEndpoints map[string]string
+}
+
+// ValidateEndpointOptions reports whether the endpoint templates are valid and the default strategy exists.
+func ValidateEndpointOptions(opts EndpointOptions) error {
+	_, err := newEndpoints(opts)
+	return err
+}
+
+func newEndpoints(opts EndpointOptions) (*endpoints, error) {
+	e := &endpoints{
+		def:          opts.Default,
+		label:        opts.Label,
+		templates:    make(map[string]*template.Template),
+		dnsEndpoints: make(map[string]string),
+	}
+	if e.def == "" {
+		e.def = ConnectGatewayEndpoint
+	}
+	sample := EndpointParams{
+		ProjectNum:      "123456",
+		Location:        "us-central1",
+		MembershipID:    "membership",
+		Membership:      &fleet.Membership{Name: "projects/123456/locations/us-central1/memberships/membership"},
+		ClusterProject:  "my-project",
+		ClusterLocation: "us-central1",
+		ClusterName:     "cluster",
+	}
+	for name, text := range opts.Templates {
+		if name == ConnectGatewayEndpoint || name == DNSEndpoint {
+			return nil, fmt.Errorf("endpoint template %q overrides a built-in strategy", name)
+		}
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse endpoint template %q: %w", name, err)
+		}
+		if _, err := renderEndpoint(tmpl, sample); err != nil {
+			return nil, fmt.Errorf("invalid endpoint template %q: %w", name, err)
+		}
+		e.templates[name] = tmpl
+	}
+	if !e.known(e.def) {
+		return nil, fmt.Errorf("unknown default endpoint strategy %q", e.def)
+	}
+	return e, nil
+}
+
+func (e *endpoints) known(strategy string) bool {
+	_, ok := e.templates[strategy]
+	return ok || strategy == ConnectGatewayEndpoint || strategy == DNSEndpoint
+}
+
+// strategy returns the endpoint strategy of the membership. Unknown strategies in the membership label fall back to
+// the default one, so that a mistyped label does not fail the refresh of the whole fleet.
+func (e *endpoints) strategy(mem *fleet.Membership) string {
+	if e.label == "" {
+		return e.def
+	}
+	s, ok := mem.Labels[e.label]
+	if !ok {
+		return e.def
+	}
+	if !e.known(s) {
+		slog.Warn("Unknown endpoint strategy of membership, using the default one", "membership", mem.Name, "strategy", s, "default", e.def)
+		return e.def
+	}
+	return s
+}
+
+// serverURL resolves the server URL of the membership. A nil endpoints resolves Connect Gateway URLs.
+func (e *endpoints) serverURL(ctx context.Context, backend Backend, projectNum string, mem *fleet.Membership) (string, error) {
+	parts := strings.Split(mem.Name, "/")
+	params := EndpointParams{
+		ProjectNum:   projectNum,
+		Location:     parts[3],
+		MembershipID: parts[5],
+		Membership:   mem,
+	}
+	cluster := gkeCluster(mem)
+	if cluster != "" {
+		cp := strings.Split(cluster, "/")
+		params.ClusterProject, params.ClusterLocation, params.ClusterName = cp[1], cp[3], cp[5]
+	}
+	if e == nil {
+		return connectGatewayURL(projectNum, params.Location, params.MembershipID), nil
+	}
+
+	switch s := e.strategy(mem); s {
+	case ConnectGatewayEndpoint:
+		return connectGatewayURL(projectNum, params.Location, params.MembershipID), nil
+	case DNSEndpoint:
+		if cluster == "" {
+			return connectGatewayURL(projectNum, params.Location, params.MembershipID), nil
+		}
+		// The DNS endpoint of a cluster never changes, so it is only looked up once.
+		if ep, ok := e.dnsEndpoints[cluster]; ok {
+			return ep, nil
+		}
+		ep, err := backend.GetClusterDNSEndpoint(ctx, cluster)
+		if err != nil {
+			return "", fmt.Errorf("failed to get the DNS endpoint of cluster %s: %w", cluster, err)
+		}
+		if ep == "" {
+			return "", fmt.Errorf("cluster %s has no DNS endpoint", cluster)
+		}
+		e.dnsEndpoints[cluster] = "https://" + ep
+		return e.dnsEndpoints[cluster], nil
+	default:
+		return renderEndpoint(e.templates[s], params)
+	}
+}
+
+// pruneDNSEndpoints forgets the DNS endpoints of the GKE clusters of no membership, eg. of deleted clusters.
+func (e *endpoints) pruneDNSEndpoints(mems []*fleet.Membership) {
+	if e == nil {
+		return
+	}
+	clusters := make(map[string]bool)
+	for _, mem := range mems {
+		clusters[gkeCluster(mem)] = true
+	}
+	for cluster := range e.dnsEndpoints {
+		if !clusters[cluster] {
+			delete(e.dnsEndpoints, cluster)
+		}
+	}
+}
+
+// gkeCluster returns the GKE cluster name of the membership, eg.
+// projects/my-project/locations/us-central1/clusters/my-cluster, or "" for non-GKE clusters.
+func gkeCluster(mem *fleet.Membership) string {
+	if mem.Endpoint == nil || mem.Endpoint.GkeCluster == nil || !strings.HasPrefix(mem.Endpoint.GkeCluster.ResourceLink, gkeResourceLinkPrefix) {
+		return ""
+	}
+	cluster := strings.TrimPrefix(mem.Endpoint.GkeCluster.ResourceLink, gkeResourceLinkPrefix)
+	if cp := strings.Split(cluster, "/"); len(cp) != 6 || cp[0] != "projects" || cp[2] != "locations" || cp[4] != "clusters" {
+		return ""
+	}
+	return cluster
+}
+
+// renderEndpoint executes an endpoint template and validates the resulting URL.
+func renderEndpoint(tmpl *template.Template, params EndpointParams) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, params); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(strings.TrimSpace(buf.String()))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("server URL %q is not an https URL", u)
+	}
+	return u.String(), nil
+}
+
+func connectGatewayURL(projectNum, region, membershipID string) string {
+	if region == "global" {
+		return fmt.Sprintf("https://connectgateway.googleapis.com/v1/projects/%s/locations/%s/gkeMemberships/%s", projectNum, region, membershipID)
+	}
+	return fmt.Sprintf("https://%s-connectgateway.googleapis.com/v1/projects/%s/locations/%s/gkeMemberships/%s", region, projectNum, region, membershipID)
+}
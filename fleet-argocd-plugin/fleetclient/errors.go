@@ -0,0 +1,29 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import "errors"
+
+// Errors returned by the fleet client, to be checked with errors.Is.
+var (
+	// ErrInvalidRequest is returned for malformed plugin request parameters.
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrProjectNotAllowed is returned for fleet host projects outside of the allow-list.
+	ErrProjectNotAllowed = errors.New("fleet project not served by the Fleet plugin")
+	// ErrUnknownScope is returned for scope IDs which do not exist in the fleet.
+	ErrUnknownScope = errors.New("unknown scope")
+	// ErrNotSynced is returned when the fleet topology has never been fetched successfully.
+	ErrNotSynced = errors.New("fleet not synced")
+	// ErrStale is returned when the most recent refresh failed and the last-known-good topology is not served.
+	ErrStale = errors.New("fleet topology is stale")
+)
@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	// Maximum number of change notifications pulled at once.
+	maxPulledMessages = 100
+	// Maximum delay between pulls when backing off from Pub/Sub errors.
+	maxPullBackoff = time.Minute
+)
+
+// fleetAssetPrefix prefixes the Cloud Asset Inventory asset types of the fleet resources, eg.
+// gkehub.googleapis.com/Membership or gkehub.googleapis.com/MembershipBinding.
+const fleetAssetPrefix = "gkehub.googleapis.com/"
+
+// assetNotification is the part of a Cloud Asset Inventory feed notification, a TemporalAsset, used to route it.
+type assetNotification struct {
+	Asset      *asset `json:"asset"`
+	PriorAsset *asset `json:"priorAsset"`
+}
+
+type asset struct {
+	// Name is the full resource name, eg. //gkehub.googleapis.com/projects/123456/locations/global/memberships/m.
+	Name      string `json:"name"`
+	AssetType string `json:"assetType"`
+	// Ancestors are the resource names of the project, folders and organization of the asset, eg. projects/123456.
+	Ancestors []string `json:"ancestors"`
+}
+
+// Subscriber triggers refreshes of the fleets of a Registry on the change notifications of a Pub/Sub subscription, fed
+// by Cloud Asset Inventory feeds of the fleet resources. Notifications are routed to fleet projects, not resources: a
+// change of one membership refreshes the whole fleet of its project.
+type Subscriber struct {
+	svc          *pubsub.Service
+	subscription string
+	registry     *Registry
+}
+
+// NewSubscriber creates a Subscriber pulling the subscription, eg. projects/my-project/subscriptions/fleet-changes,
+// from the Pub/Sub API at endpoint, or the default endpoint if empty. Plain http endpoints, such as the Pub/Sub
+// emulator, are called without authentication.
+func NewSubscriber(ctx context.Context, subscription, endpoint string, registry *Registry) (*Subscriber, error) {
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+		if strings.HasPrefix(endpoint, "http://") {
+			opts = append(opts, option.WithoutAuthentication())
+		}
+	}
+	svc, err := pubsub.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Subscriber{svc: svc, subscription: subscription, registry: registry}, nil
+}
+
+// Run pulls change notifications until the context is done. Notifications are acknowledged once their refreshes are
+// triggered, so that those lost to a restart are redelivered.
+func (s *Subscriber) Run(ctx context.Context) {
+	failures := 0
+	for {
+		resp, err := s.svc.Projects.Subscriptions.Pull(s.subscription, &pubsub.PullRequest{MaxMessages: maxPulledMessages}).Context(ctx).Do()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures++
+			delay := min(time.Second<<min(failures, 10), maxPullBackoff)
+			slog.Error("Error pulling change notifications", "subscription", s.subscription, "failures", failures, "retryIn", delay, "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		failures = 0
+		if len(resp.ReceivedMessages) == 0 {
+			continue
+		}
+
+		ackIDs := make([]string, 0, len(resp.ReceivedMessages))
+		projects := make(map[string]bool)
+		for _, m := range resp.ReceivedMessages {
+			ackIDs = append(ackIDs, m.AckId)
+			if project, ok := s.route(m.Message); ok {
+				projects[project] = true
+			}
+		}
+		s.trigger(projects)
+		_, err = s.svc.Projects.Subscriptions.Acknowledge(s.subscription, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Context(ctx).Do()
+		if err != nil && ctx.Err() == nil {
+			// The notifications are redelivered, triggering redundant refreshes.
+			slog.Warn("Error acknowledging change notifications", "subscription", s.subscription, "error", err)
+		}
+	}
+}
+
+// route returns the fleet host project of a change notification of a fleet resource, or "" if its project is not
+// known by number, and whether the notification is about a fleet resource at all.
+func (s *Subscriber) route(m *pubsub.PubsubMessage) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	data, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		slog.Warn("Ignoring invalid change notification", "messageId", m.MessageId, "error", err)
+		return "", false
+	}
+	var n assetNotification
+	if err := json.Unmarshal(data, &n); err != nil {
+		slog.Warn("Ignoring invalid change notification", "messageId", m.MessageId, "error", err)
+		return "", false
+	}
+	a := n.Asset
+	if a == nil {
+		// Deletions may only carry the prior state of the asset.
+		a = n.PriorAsset
+	}
+	if a == nil || !strings.HasPrefix(a.AssetType, fleetAssetPrefix) {
+		return "", false
+	}
+	changeNotifications.WithLabelValues(a.AssetType).Inc()
+	return assetProject(a), true
+}
+
+// assetProject returns the number of the project of the asset, from its ancestors, or its name if it is named by
+// project number rather than ID.
+func assetProject(a *asset) string {
+	for _, ancestor := range a.Ancestors {
+		if project, ok := strings.CutPrefix(ancestor, "projects/"); ok {
+			return project
+		}
+	}
+	parts := strings.Split(a.Name, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if _, err := strconv.ParseUint(parts[i+1], 10, 64); parts[i] == "projects" && err == nil {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// trigger triggers the refresh of the served fleets of the projects, or of every served fleet if one of them is not
+// known. Fleets which have not been requested yet are refreshed on their first request anyway.
+func (s *Subscriber) trigger(projects map[string]bool) {
+	if len(projects) == 0 {
+		return
+	}
+	for project, c := range s.registry.FleetSyncs() {
+		if projects[project] || projects[""] {
+			c.TriggerRefresh()
+		}
+	}
+}
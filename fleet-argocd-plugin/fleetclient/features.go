@@ -0,0 +1,46 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"strings"
+
+	fleet "google.golang.org/api/gkehub/v1"
+)
+
+// FeatureState is the state of a fleet feature, eg. configmanagement or servicemesh, on a membership.
+type FeatureState struct {
+	// State is the feature state code, eg. "OK", "WARNING" or "ERROR".
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
+
+// featureStates maps the features to their state on each membership, by membership full resource name and feature
+// name, eg. "configmanagement".
+func featureStates(features []*fleet.Feature) map[string]map[string]FeatureState {
+	ret := make(map[string]map[string]FeatureState)
+	for _, f := range features {
+		name := f.Name[strings.LastIndex(f.Name, "/")+1:]
+		for membership, ms := range f.MembershipStates {
+			state := FeatureState{State: "CODE_UNSPECIFIED"}
+			if ms.State != nil && ms.State.Code != "" {
+				state = FeatureState{State: ms.State.Code, Description: ms.State.Description}
+			}
+			if ret[membership] == nil {
+				ret[membership] = make(map[string]FeatureState)
+			}
+			ret[membership][name] = state
+		}
+	}
+	return ret
+}
@@ -13,29 +13,42 @@
 package fleetclient
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	fleet "google.golang.org/api/gkehub/v1"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"google.golang.org/api/googleapi"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 const (
-	// Fleet API service poll interval.
-	reconcileInterval = 10 * time.Second
+	// Default Fleet API service poll interval.
+	defaultRefreshInterval = 10 * time.Second
+	// Default deadline of each Fleet API call, including all its pages.
+	defaultAPITimeout = 30 * time.Second
+	// Default maximum delay between refreshes when backing off from failures.
+	defaultMaxBackoff = 5 * time.Minute
+	// Default number of consecutive refreshes a membership must be absent from before its secret is pruned.
+	defaultPruneAfterRefreshes = 3
+	// Default maximum fraction of the managed cluster secrets pruned in one refresh.
+	defaultMaxPruneFraction = 0.5
+	// Maximum number of concurrent Fleet API calls listing the namespaces of scopes.
+	maxConcurrentCalls = 8
 	// Template for the Kubernetes Secret name, {{.MembershipID}}.{{.Region}}.{{.ProjectNum}}.
 	clusterSecretNameTemplate = "%s.%s.%s"
-	// Template for the Kubernetes Secret manifest.
+	// Default template for the Kubernetes Secret manifest, with SecretTemplateParams.
 	clusterSecretTemplate = `
 apiVersion: v1
 kind: Secret
@@ -49,7 +62,7 @@ metadata:
 type: Opaque
 stringData:
   name: {{.Name}}
-  server: {{.ConnectGatewayURL}}
+  server: {{.ServerURL}}
   config: |
     {
       "execProviderConfig": {
@@ -65,26 +78,177 @@ stringData:
 `
 )
 
+// Options configures a FleetSync.
+type Options struct {
+	// RefreshInterval is the Fleet API poll interval, 10 seconds if zero.
+	RefreshInterval time.Duration
+	// APITimeout is the deadline of each Fleet API call, 30 seconds if zero.
+	APITimeout time.Duration
+	// MaxBackoff is the maximum delay between refreshes after consecutive failures, 5 minutes if zero.
+	MaxBackoff time.Duration
+	// Endpoint overrides the GKE Hub API endpoint, eg. a local simulator.
+	Endpoint string
+	// ContainerEndpoint overrides the GKE API endpoint, which looks up the DNS endpoints of clusters.
+	ContainerEndpoint string
+	// Backend overrides the GKE Hub API client created for Endpoint, eg. in tests.
+	Backend Backend
+	// KubeClient overrides the in-cluster Kubernetes client used to reconcile cluster secrets.
+	KubeClient kubernetes.Interface
+	// DynamicClient overrides the in-cluster Kubernetes client used to reconcile AppProjects.
+	DynamicClient dynamic.Interface
+	// DisableSecrets skips the reconciliation of Argo CD cluster secrets, eg. when running outside of a cluster.
+	DisableSecrets bool
+	// PruneAfterRefreshes is the number of consecutive refreshes a membership must be absent from before its cluster
+	// secret is pruned, 3 if zero.
+	PruneAfterRefreshes int
+	// PruneGracePeriod is the minimum time a membership must be absent for before its cluster secret is pruned.
+	PruneGracePeriod time.Duration
+	// MaxPruneFraction is the maximum fraction of the managed cluster secrets of the fleet pruned in one refresh,
+	// above which nothing is pruned, 0.5 if zero. A single secret may always be pruned.
+	MaxPruneFraction float64
+	// MembershipStates are the membership state codes of deploy targets, READY only if empty.
+	MembershipStates []string
+	// StateGracePeriod keeps a membership which leaves the included states as a deploy target for this long.
+	StateGracePeriod time.Duration
+	// SecretTemplate is the text/template of the cluster secret manifests, with SecretTemplateParams. The default
+	// template is used if empty.
+	SecretTemplate string
+	// Endpoints selects the server URLs of the member clusters, Connect Gateway by default.
+	Endpoints EndpointOptions
+	// ScopeNamespacedSecrets restricts the cluster secret of each membership to the fleet namespaces of its scopes,
+	// without cluster-scoped resources. Memberships bound to no fleet namespace get no cluster secret.
+	ScopeNamespacedSecrets bool
+	// AppProjects, if not nil, enables the reconciliation of one Argo CD AppProject per scope.
+	AppProjects *AppProjectOptions
+
+	// caches are the informer caches shared by the FleetSyncs of a Registry.
+	caches *informerCaches
+}
+
 // FleetSync is a client that periodically polls the GKE Fleet API and caches fleet information.
 type FleetSync struct {
-	svc *fleet.Service
+	backend Backend
+	// secrets is nil when the reconciliation of cluster secrets is disabled.
+	secrets                *secretReconciler
+	scopeNamespacedSecrets bool
+	// appProjects is nil when the reconciliation of AppProjects is disabled.
+	appProjects     *appProjectReconciler
+	secretTemplate  *template.Template
+	endpoints       *endpoints
+	refreshInterval time.Duration
+	apiTimeout      time.Duration
+	maxBackoff      time.Duration
+	trigger         chan struct{}
+	// done is closed when the reconciliation stops.
+	done             chan struct{}
+	membershipStates []string
+	stateGracePeriod time.Duration
+	// Last time each listed membership was in an included state, only accessed by refreshes.
+	lastIncluded map[string]time.Time
+	// Last-known-good snapshot of each location, and the time since which the unreachable locations are, only
+	// accessed by refreshes.
+	regions          map[string]*regionSnapshot
+	unreachableSince map[string]time.Time
+
+	mu sync.Mutex
+	// Time of the last successful refresh.
+	lastRefresh time.Time
+	// Error of the most recent refresh, nil if it succeeded.
+	lastRefreshErr error
+	// Memberships excluded because of their state.
+	excluded []ExcludedMembership
 	// GCP project number of fleet host project.
 	ProjectNum string
+	// A cached map from Membership full resource name to the Membership.
+	MembershipCache map[string]*fleet.Membership
 	// A cached map from Membership full resource name to a list of Scope IDs.
 	MembershipTenancyMapCache map[string][]string
 	// A cached map from Scope IDs to a list of Membership full resource names.
 	ScopeTenancyMapCache map[string][]string
+	// A cached map from Scope IDs to the fleet namespaces of the scope.
+	ScopeNamespacesCache map[string][]*fleet.Namespace
+	// A cached map from Membership full resource name to the server URL of the cluster.
+	ServerURLCache map[string]string
+	// A cached map from Membership full resource name to the state of each fleet feature on the membership.
+	FeatureCache map[string]map[string]FeatureState
 }
 
 // NewFleetSync creates a new FleetSync and starts its periodical reconciliation.
-func NewFleetSync(ctx context.Context, projectNum string) (*FleetSync, error) {
-	service, err := fleet.NewService(ctx)
+func NewFleetSync(ctx context.Context, projectNum string, opts Options) (_ *FleetSync, err error) {
+	// The informers of the reconcilers are stopped if the FleetSync is not created, eg. when its initial refresh
+	// fails, so that retries do not leak watches.
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+	backend := opts.Backend
+	if backend == nil {
+		if backend, err = NewBackend(ctx, opts.Endpoint, opts.ContainerEndpoint); err != nil {
+			return nil, err
+		}
+	}
+	tmplText := opts.SecretTemplate
+	if tmplText == "" {
+		tmplText = clusterSecretTemplate
+	}
+	tmpl, err := ParseSecretTemplate(tmplText)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := newEndpoints(opts.Endpoints)
 	if err != nil {
 		return nil, err
 	}
+	// Without a Registry, the informers are only shared by this FleetSync, and stop with it.
+	caches := opts.caches
+	if caches == nil {
+		caches = &informerCaches{ctx: ctx}
+	}
+	var secrets *secretReconciler
+	if !opts.DisableSecrets {
+		cache, err := caches.secretInformer(opts.KubeClient)
+		if err != nil {
+			return nil, err
+		}
+		secrets = &secretReconciler{secretCache: cache, guard: newPruneGuard("cluster secrets", opts, secretPruneMetrics)}
+	}
+	var appProjects *appProjectReconciler
+	if opts.AppProjects != nil {
+		cache, err := caches.appProjectInformer(opts.DynamicClient)
+		if err != nil {
+			return nil, err
+		}
+		appProjects = &appProjectReconciler{appProjectCache: cache, opts: opts.AppProjects, guard: newPruneGuard("AppProjects", opts, appProjectPruneMetrics)}
+	}
 	c := &FleetSync{
-		svc:        service,
-		ProjectNum: projectNum,
+		backend:                backend,
+		secrets:                secrets,
+		appProjects:            appProjects,
+		secretTemplate:         tmpl,
+		scopeNamespacedSecrets: opts.ScopeNamespacedSecrets,
+		endpoints:              endpoints,
+		refreshInterval:        opts.RefreshInterval,
+		apiTimeout:             opts.APITimeout,
+		maxBackoff:             opts.MaxBackoff,
+		trigger:                make(chan struct{}, 1),
+		done:                   make(chan struct{}),
+		membershipStates:       opts.MembershipStates,
+		stateGracePeriod:       opts.StateGracePeriod,
+		ProjectNum:             projectNum,
+	}
+	if c.refreshInterval == 0 {
+		c.refreshInterval = defaultRefreshInterval
+	}
+	if c.apiTimeout == 0 {
+		c.apiTimeout = defaultAPITimeout
+	}
+	if c.maxBackoff == 0 {
+		c.maxBackoff = max(defaultMaxBackoff, c.refreshInterval)
+	}
+	if len(c.membershipStates) == 0 {
+		c.membershipStates = []string{readyState}
 	}
 
 	// Build the initial fleet topology before handling RPCs.
@@ -98,92 +262,402 @@ func NewFleetSync(ctx context.Context, projectNum string) (*FleetSync, error) {
 
 func (c *FleetSync) startReconcile(ctx context.Context) {
 	go func() {
+		defer close(c.done)
+		failures := 0
+		quotaExceeded := false
 		for {
-			time.Sleep(reconcileInterval)
-			if err := c.Refresh(ctx); err != nil {
-				fmt.Printf("Error refreshing fleet: %v\n", err)
+			if !c.wait(ctx, c.refreshDelay(failures), quotaExceeded) {
+				return
+			}
+			err := c.Refresh(ctx)
+			if err == nil {
+				failures, quotaExceeded = 0, false
+				continue
 			}
+			failures++
+			quotaExceeded = isQuotaError(err)
+			refreshErrors.WithLabelValues(c.ProjectNum).Inc()
+			slog.Error("Error refreshing fleet", "project", c.ProjectNum, "lastRefresh", c.LastRefresh(), "failures", failures, "error", err)
 		}
 	}()
 }
 
+// Done returns a channel closed when the periodical reconciliation stops, once the context of NewFleetSync is done.
+func (c *FleetSync) Done() <-chan struct{} {
+	return c.done
+}
+
+// wait waits for the delay, or a refresh trigger unless ignoreTriggers, and returns false if the context is done.
+func (c *FleetSync) wait(ctx context.Context, delay time.Duration, ignoreTriggers bool) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	trigger := c.trigger
+	if ignoreTriggers {
+		// Triggered refreshes would only exhaust the quota further.
+		trigger = nil
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	case <-trigger:
+	}
+	return true
+}
+
+// refreshDelay returns the refresh interval, backed off exponentially with jitter after consecutive failures.
+func (c *FleetSync) refreshDelay(failures int) time.Duration {
+	if failures == 0 {
+		return c.refreshInterval
+	}
+	return backoff(c.refreshInterval, c.maxBackoff, failures)
+}
+
+// backoff returns the interval doubled per consecutive failure up to maxBackoff, with jitter between half and the
+// full delay, so that the retries of several fleets do not synchronize.
+func backoff(interval, maxBackoff time.Duration, failures int) time.Duration {
+	delay := maxBackoff
+	// Comparing before shifting, as the shifted interval overflows after enough failures.
+	if failures < 63 && interval <= maxBackoff>>failures {
+		delay = interval << failures
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// TriggerRefresh requests a refresh of the fleet without waiting for the refresh interval. Triggers are coalesced
+// with the pending refresh, and ignored while backing off from quota errors.
+func (c *FleetSync) TriggerRefresh() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// isQuotaError reports whether err is a Google API quota error.
+func isQuotaError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests
+}
+
+// LastRefresh returns the time of the last successful refresh.
+func (c *FleetSync) LastRefresh() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastRefresh
+}
+
+// RefreshStatus returns the time of the last successful refresh, and the error of the most recent refresh if it
+// failed, in which case the cached topology is the last-known-good one.
+func (c *FleetSync) RefreshStatus() (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastRefresh, c.lastRefreshErr
+}
+
 // Result encapsulates the response from the fleet service.
+//
+// Besides the flat keys, Metadata nests the same membership information for ApplicationSets using Go templates,
+// eg. `{{ index .metadata.labels "env" }}`.
 type Result struct {
 	ServerURL string `json:"server"`
 	Name      string `json:"name"`
 	NameShort string `json:"nameShort"`
+	// Location of the membership, eg. "us-central1" or "global".
+	Location string `json:"location"`
+	// Project number of the fleet host project.
+	Project string `json:"project"`
+	// Comma separated IDs of the scopes the membership is bound to.
+	Scopes string `json:"scopes"`
+	// Kubernetes API server version of the member cluster.
+	KubernetesVersion string `json:"kubernetesVersion"`
+	// Resource link of the underlying GKE cluster, empty for non-GKE clusters.
+	ClusterResourceLink string `json:"clusterResourceLink"`
+	// Fleet namespace of the scope, only set by NamespaceResults.
+	Namespace string         `json:"namespace,omitempty"`
+	Metadata  ResultMetadata `json:"metadata"`
+	// Values requested by the ApplicationSet, resolved for the membership, set by ApplyValues. They are not returned
+	// under "values", which Argo CD replaces with the plugin.values of the generator when goTemplate is enabled.
+	Values map[string]any `json:"resolvedValues,omitempty"`
+	// State of the fleet features enabled on the membership by feature name, eg. features.configmanagement.state.
+	Features map[string]FeatureState `json:"features"`
+	// Rollout wave of the membership, set by ApplyWaves.
+	Wave int `json:"wave"`
 }
 
-// PluginResults returns the results of the plugin.
-func (c *FleetSync) PluginResults(ctx context.Context, scopeID string) ([]Result, error) {
+// ResultMetadata is the nested membership information of a Result.
+type ResultMetadata struct {
+	Location            string            `json:"location"`
+	Project             string            `json:"project"`
+	Labels              map[string]string `json:"labels"`
+	Scopes              []string          `json:"scopes"`
+	KubernetesVersion   string            `json:"kubernetesVersion"`
+	ClusterResourceLink string            `json:"clusterResourceLink"`
+	Namespace           string            `json:"namespace,omitempty"`
+	NamespaceLabels     map[string]string `json:"namespaceLabels,omitempty"`
+}
+
+// PluginResults returns the results of the plugin, for the memberships matching the selector.
+// An empty fleet, or a scope without memberships, returns no results rather than an error.
+func (c *FleetSync) PluginResults(ctx context.Context, scopeID string, selector Selector) (ret []Result, err error) {
+	_, span := tracer.Start(ctx, "FleetSync.PluginResults", trace.WithAttributes(
+		attribute.String("fleet.project", c.ProjectNum), attribute.String("fleet.scope", scopeID)))
+	defer func() {
+		span.SetAttributes(attribute.Int("fleet.results", len(ret)))
+		EndSpan(span, err)
+	}()
+	sel, err := selector.compile()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.MembershipTenancyMapCache == nil || c.ScopeTenancyMapCache == nil {
-		return nil, fmt.Errorf("fleet is empty")
+		return nil, ErrNotSynced
 	}
-	var results []Result
+	results := []Result{}
 
 	// Scope mode. Only include memberships in the specified scope.
 	if scopeID != "" {
-		if c.ScopeTenancyMapCache[scopeID] == nil {
-			return nil, fmt.Errorf("unknown scope ID to the Fleet plugin: %s", scopeID)
+		if _, ok := c.ScopeTenancyMapCache[scopeID]; !ok {
+			return nil, fmt.Errorf("%w to the Fleet plugin: %s", ErrUnknownScope, scopeID)
 		}
 		for _, name := range c.ScopeTenancyMapCache[scopeID] {
-			results = append(results, resultFromMembership(name, c.ProjectNum))
+			if r := c.resultFromMembership(name); sel.matches(r) {
+				results = append(results, r)
+			}
 		}
 		return results, nil
 	}
 
 	// Include all member clusters in the Fleet.
 	for name := range c.MembershipTenancyMapCache {
-		results = append(results, resultFromMembership(name, c.ProjectNum))
+		if r := c.resultFromMembership(name); sel.matches(r) {
+			results = append(results, r)
+		}
 	}
 	return results, nil
 }
 
-func resultFromMembership(name, projectNum string) Result {
+// NamespaceResults returns one result per fleet namespace of the scope, for each membership bound to the scope
+// and matching the selector.
+func (c *FleetSync) NamespaceResults(ctx context.Context, scopeID string, selector Selector) ([]Result, error) {
+	if scopeID == "" {
+		return nil, fmt.Errorf("%w: scope ID is required to list fleet namespaces", ErrInvalidRequest)
+	}
+	mems, err := c.PluginResults(ctx, scopeID, selector)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := []Result{}
+	for _, r := range mems {
+		for _, ns := range c.ScopeNamespacesCache[scopeID] {
+			nsID := ns.Name[strings.LastIndex(ns.Name, "/")+1:]
+			r.Namespace = nsID
+			r.Metadata.Namespace = nsID
+			r.Metadata.NamespaceLabels = ns.NamespaceLabels
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+func (c *FleetSync) resultFromMembership(name string) Result {
 	parts := strings.Split(name, "/")
 	region, membershipID := parts[3], parts[5]
-	return Result{
-		ServerURL: connectGatewayURL(projectNum, region, membershipID),
-		Name:      fmt.Sprintf(clusterSecretNameTemplate, membershipID, region, projectNum),
-		NameShort: fmt.Sprint(membershipID),
+
+	scopes := append([]string{}, c.MembershipTenancyMapCache[name]...)
+	sort.Strings(scopes)
+	md := ResultMetadata{
+		Location: region,
+		Project:  c.ProjectNum,
+		Labels:   make(map[string]string),
+		Scopes:   scopes,
+	}
+	features := make(map[string]FeatureState)
+	for f, state := range c.FeatureCache[name] {
+		features[f] = state
+	}
+	if mem := c.MembershipCache[name]; mem != nil {
+		for k, v := range mem.Labels {
+			md.Labels[k] = v
+		}
+		if ep := mem.Endpoint; ep != nil {
+			if ep.KubernetesMetadata != nil {
+				md.KubernetesVersion = ep.KubernetesMetadata.KubernetesApiServerVersion
+			}
+			if ep.GkeCluster != nil {
+				md.ClusterResourceLink = ep.GkeCluster.ResourceLink
+			}
+		}
 	}
-}
 
-func connectGatewayURL(projectNum, region, membershipID string) string {
-	if region == "global" {
-		return fmt.Sprintf("https://connectgateway.googleapis.com/v1/projects/%s/locations/%s/gkeMemberships/%s", projectNum, region, membershipID)
+	return Result{
+		ServerURL:           c.ServerURLCache[name],
+		Name:                fmt.Sprintf(clusterSecretNameTemplate, membershipID, region, c.ProjectNum),
+		NameShort:           fmt.Sprint(membershipID),
+		Location:            md.Location,
+		Project:             md.Project,
+		Scopes:              strings.Join(md.Scopes, ","),
+		KubernetesVersion:   md.KubernetesVersion,
+		ClusterResourceLink: md.ClusterResourceLink,
+		Metadata:            md,
+		Features:            features,
 	}
-	return fmt.Sprintf("https://%s-connectgateway.googleapis.com/v1/projects/%s/locations/%s/gkeMemberships/%s", region, projectNum, region, membershipID)
 }
 
 // Refresh polls fleet API, rebuilds the local cached fleet topology map, and updates cluster secrets.
+// On failure, the previously cached topology is kept as the last-known-good one.
 func (c *FleetSync) Refresh(ctx context.Context) error {
-	mems, err := c.listMemberships(ctx, c.ProjectNum)
+	ctx, span := tracer.Start(ctx, "FleetSync.Refresh", trace.WithAttributes(attribute.String("fleet.project", c.ProjectNum)))
+	err := c.refresh(ctx)
+	EndSpan(span, err)
+	now := time.Now()
+	c.mu.Lock()
+	c.lastRefreshErr = err
+	if err == nil {
+		c.lastRefresh = now
+	}
+	c.mu.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to list memberships: %w", err)
+		return err
 	}
+	lastRefreshTimestamp.WithLabelValues(c.ProjectNum).Set(float64(now.Unix()))
+	return nil
+}
 
-	scopes, err := c.listScopes(ctx, c.ProjectNum)
+// listScopes lists the scopes, and the fleet namespaces of each scope by scope ID.
+func (c *FleetSync) listScopes(ctx context.Context) ([]*fleet.Scope, map[string][]*fleet.Namespace, error) {
+	listCtx, cancel := context.WithTimeout(ctx, c.apiTimeout)
+	defer cancel()
+	scopes, err := c.backend.ListScopes(listCtx, c.ProjectNum)
 	if err != nil {
-		return fmt.Errorf("failed to list scopes: %w", err)
+		return nil, nil, fmt.Errorf("failed to list scopes: %w", err)
 	}
 
-	mbs, err := c.listMembershipBindings(ctx, c.ProjectNum)
-	if err != nil {
-		return fmt.Errorf("failed to list membership bindings: %w", err)
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, maxConcurrentCalls)
+		nss  = make([][]*fleet.Namespace, len(scopes))
+		errs = make([]error, len(scopes))
+	)
+	for i, s := range scopes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			ctx, cancel := context.WithTimeout(ctx, c.apiTimeout)
+			defer cancel()
+			if nss[i], errs[i] = c.backend.ListScopeNamespaces(ctx, s.Name); errs[i] != nil {
+				errs[i] = fmt.Errorf("failed to list namespaces of scope %s: %w", s.Name, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, err
 	}
+	scopeNamespaces := make(map[string][]*fleet.Namespace)
+	for i, s := range scopes {
+		scopeNamespaces[s.Name[strings.LastIndex(s.Name, "/")+1:]] = nss[i]
+	}
+	return scopes, scopeNamespaces, nil
+}
+
+// serverURL resolves the server URL of the membership, within the deadline of Fleet API calls.
+func (c *FleetSync) serverURL(ctx context.Context, mem *fleet.Membership) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.apiTimeout)
+	defer cancel()
+	return c.endpoints.serverURL(ctx, c.backend, c.ProjectNum, mem)
+}
+
+func (c *FleetSync) refresh(ctx context.Context) error {
+	var (
+		wg              sync.WaitGroup
+		mems            []*fleet.Membership
+		scopes          []*fleet.Scope
+		scopeNamespaces map[string][]*fleet.Namespace
+		mbs             []*fleet.MembershipBinding
+		features        []*fleet.Feature
+		featuresErr     error
+		unreachable     [2][]string
+		errs            [3]error
+	)
+	// List calls are concurrent, so that a slow one does not delay the others, and bounded by apiTimeout each.
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, c.apiTimeout)
+		defer cancel()
+		if mems, unreachable[0], errs[0] = c.backend.ListMemberships(ctx, c.ProjectNum); errs[0] != nil {
+			errs[0] = fmt.Errorf("failed to list memberships: %w", errs[0])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		scopes, scopeNamespaces, errs[1] = c.listScopes(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, c.apiTimeout)
+		defer cancel()
+		if mbs, unreachable[1], errs[2] = c.backend.ListMembershipBindings(ctx, c.ProjectNum); errs[2] != nil {
+			errs[2] = fmt.Errorf("failed to list membership bindings: %w", errs[2])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, c.apiTimeout)
+		defer cancel()
+		features, featuresErr = c.backend.ListFeatures(ctx, c.ProjectNum)
+	}()
+	wg.Wait()
+	if err := errors.Join(errs[:]...); err != nil {
+		return err
+	}
+	// Feature states only annotate the fleet topology, so a failed feature list keeps the last-known ones rather
+	// than failing the refresh.
+	if featuresErr != nil {
+		slog.Warn("Error listing features, keeping the last-known feature states", "project", c.ProjectNum, "error", featuresErr)
+		featureListErrors.WithLabelValues(c.ProjectNum).Inc()
+	}
+	mems, mbs = c.mergeRegions(mems, mbs, appendLocations(unreachable[0], unreachable[1]), time.Now())
 
 	// Build one map from Memberships to a list of Scopes that the membership cluster is associated with,
 	// and one reverse indexed map from Scopes to Memberships.
+	// Memberships which are not in one of the included states are not deploy targets.
+	included, excluded := c.filterMemberships(mems, time.Now())
+	memCache := make(map[string]*fleet.Membership)
 	memTenancyMap := make(map[string][]string)
-	for _, mem := range mems {
+	serverURLs := make(map[string]string)
+	for _, mem := range included {
 		membershipName := mem.Name
+		memCache[membershipName] = mem
 		memTenancyMap[membershipName] = make([]string, 0)
+		// A failed endpoint lookup falls back to the last-known server URL of the membership, or to its Connect
+		// Gateway URL, rather than failing the refresh of the whole fleet.
+		serverURL, err := c.serverURL(ctx, mem)
+		if err != nil {
+			c.mu.Lock()
+			last := c.ServerURLCache[membershipName]
+			c.mu.Unlock()
+			if last == "" {
+				last, _ = (*endpoints)(nil).serverURL(ctx, c.backend, c.ProjectNum, mem)
+			}
+			slog.Warn("Error resolving the server URL of membership, falling back", "membership", membershipName, "serverURL", last, "error", err)
+			endpointFallbacks.WithLabelValues(c.ProjectNum).Inc()
+			serverURL = last
+		}
+		serverURLs[membershipName] = serverURL
 	}
+	c.endpoints.pruneDNSEndpoints(included)
 
+	// Scopes without bindings are known with no memberships.
 	scopeTenancyMap := make(map[string][]string)
 	for _, s := range scopes {
-		scopeID := s.Name
+		scopeID := s.Name[strings.LastIndex(s.Name, "/")+1:]
 		scopeTenancyMap[scopeID] = make([]string, 0)
 	}
 
@@ -193,15 +667,19 @@ func (c *FleetSync) Refresh(ctx context.Context) error {
 		bindingName := binding.Name
 		parts := strings.Split(bindingName, "/")
 		if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "memberships" || parts[6] != "bindings" {
-			fmt.Printf("Invalid binding resource name format: %s\n", bindingName)
+			slog.Warn("Invalid binding resource name format", "binding", bindingName)
 			continue
 		}
 
 		// Add the scope to the list for this membership
 		membership := strings.Join(parts[:6], "/")
+		if _, ok := memTenancyMap[membership]; !ok {
+			// Binding of an excluded or unknown membership.
+			continue
+		}
 		scopeParts := strings.Split(binding.Scope, "/")
 		if len(scopeParts) == 0 {
-			fmt.Printf("Invalid scope in binding (%s): %s\n", bindingName, binding.Scope)
+			slog.Warn("Invalid scope in binding", "binding", bindingName, "scope", binding.Scope)
 			continue
 		}
 
@@ -211,184 +689,28 @@ func (c *FleetSync) Refresh(ctx context.Context) error {
 	}
 
 	// Refresh cache.
+	c.mu.Lock()
+	c.MembershipCache = memCache
 	c.MembershipTenancyMapCache = memTenancyMap
 	c.ScopeTenancyMapCache = scopeTenancyMap
+	c.ScopeNamespacesCache = scopeNamespaces
+	c.ServerURLCache = serverURLs
+	if featuresErr == nil {
+		c.FeatureCache = featureStates(features)
+	}
+	c.excluded = excluded
+	c.mu.Unlock()
+
+	membershipsGauge.WithLabelValues(c.ProjectNum).Set(float64(len(mems)))
+	excludedMembershipsGauge.WithLabelValues(c.ProjectNum).Set(float64(len(excluded)))
+	scopesGauge.WithLabelValues(c.ProjectNum).Set(float64(len(scopes)))
 
 	// Update cluster Secrets.
 	if err := c.reconcileClusterSecrets(ctx); err != nil {
 		return fmt.Errorf("failed to reconcile cluster secrets: %w", err)
 	}
-	return nil
-}
-
-func (c *FleetSync) reconcileClusterSecrets(ctx context.Context) error {
-	// Create a Kubernetes clientset to apply resources.
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return fmt.Errorf("failed to get in cluster config: %w", err)
-	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return fmt.Errorf("failed to create Kubernetes clientset: %w", err)
-	}
-
-	// Construct a map of cluster secrets, from name to manifest.
-	clusterSecrets := make(map[string]string)
-	for membership := range c.MembershipTenancyMapCache {
-		parts := strings.Split(membership, "/")
-		secretName := fmt.Sprintf(clusterSecretNameTemplate, parts[5], parts[3], c.ProjectNum)
-		param := struct {
-			Name              string
-			ConnectGatewayURL string
-		}{
-			Name:              secretName,
-			ConnectGatewayURL: connectGatewayURL(c.ProjectNum, parts[3], parts[5]),
-		}
-		tmpl, err := template.New("secret").Parse(clusterSecretTemplate)
-		if err != nil {
-			return fmt.Errorf("failed to parse template: %w", err)
-		}
-		var secretManifest bytes.Buffer
-		err = tmpl.Execute(&secretManifest, param)
-		if err != nil {
-			fmt.Println("Error creating Secret manifest:", err)
-			continue
-		}
-		clusterSecrets[secretName] = secretManifest.String()
-	}
-	fmt.Printf("Reconciling Cluster Secrets: %v\n", clusterSecrets)
-
-	// Apply the Secret to the cluster.
-	err = applySecrets(ctx, clientset, clusterSecrets)
-	if err != nil {
-		return fmt.Errorf("failed to apply secret: %w", err)
-	}
-
-	// Prune cluster secrets that are no longer existing in the Fleet.
-	return pruneSecrets(ctx, clientset, clusterSecrets)
-}
-
-func applySecrets(ctx context.Context, clientset *kubernetes.Clientset, clusterSecrets map[string]string) error {
-	secretsClient := clientset.CoreV1().Secrets("argocd")
-	for _, manifest := range clusterSecrets {
-		secret, err := secretFromManifest(manifest)
-		if err != nil {
-			return fmt.Errorf("error converting manifest %q to a k8s secret: %v", manifest, err)
-		}
-		_, err = secretsClient.Create(ctx, secret, metav1.CreateOptions{})
-		if err != nil {
-			// Check if "already exists", then update.
-			if !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating secret: %v", err)
-			}
-			_, err = secretsClient.Update(ctx, secret, metav1.UpdateOptions{})
-			if err != nil {
-				return fmt.Errorf("error updating secret: %v", err)
-			}
-		}
-	}
-	fmt.Println("Successfully applied Secrets.")
-	return nil
-}
-
-func pruneSecrets(ctx context.Context, clientset *kubernetes.Clientset, clusterSecrets map[string]string) error {
-	secretsClient := clientset.CoreV1().Secrets("argocd")
-	listOptions := metav1.ListOptions{
-		LabelSelector: "argocd.argoproj.io/secret-type=cluster",
+	if err := c.reconcileAppProjects(ctx); err != nil {
+		return fmt.Errorf("failed to reconcile AppProjects: %w", err)
 	}
-
-	existingSecrets, err := secretsClient.List(ctx, listOptions)
-	if err != nil {
-		return fmt.Errorf("failed to list secrets: %w", err)
-	}
-
-	for _, secret := range existingSecrets.Items {
-		// Skip secrets that are not managed by the fleet plugin.
-		if secret.Annotations["fleet.gke.io/managed-by-fleet-plugin"] != "true" {
-			continue
-		}
-		if _, exists := clusterSecrets[secret.Name]; !exists {
-			// Secret no longer corresponds to a membership, delete it.
-			err := secretsClient.Delete(ctx, secret.Name, metav1.DeleteOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to delete secret: %w", err)
-			}
-		}
-	}
-
-	fmt.Println("Successfully pruned Secrets.")
 	return nil
 }
-
-func secretFromManifest(manifest string) (*corev1.Secret, error) {
-	// Universal deserializer can handle various Kubernetes object formats
-	scheme := runtime.NewScheme()
-	if err := corev1.AddToScheme(scheme); err != nil {
-		return nil, fmt.Errorf("error adding to scheme: %v", err)
-	}
-
-	decode := serializer.NewCodecFactory(scheme).UniversalDeserializer().Decode
-	obj, _, err := decode([]byte(manifest), nil, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding manifest %q: %v", manifest, err)
-	}
-	// Type assertion to ensure it's a corev1.Secret
-	secret, ok := obj.(*corev1.Secret)
-	if !ok {
-		return nil, fmt.Errorf("decoded object is not of type Secret")
-	}
-	return secret, nil
-}
-
-// listMemberships fetches the memberships under a given parent.
-func (c *FleetSync) listMemberships(ctx context.Context, project string) ([]*fleet.Membership, error) {
-	var ret []*fleet.Membership
-	parent := fmt.Sprintf("projects/%s/locations/-", project)
-	call := c.svc.Projects.Locations.Memberships.List(parent)
-	err := call.Pages(ctx, func(resp *fleet.ListMembershipsResponse) error {
-        // Halt reconciliation on unreachable regions (which may be transient) to prevent an incomplete list from triggering unintended deletions (Issue #113).
-		if len(resp.Unreachable) > 0 {
-			return fmt.Errorf("fleet API ListMemberships reported unreachable region(s): %v. Halting to prevent unintended deletions", resp.Unreachable)
-		}
-		ret = append(ret, resp.Resources...)
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	return ret, nil
-}
-
-// listScopes fetches the scopes under a given parent.
-func (c *FleetSync) listScopes(ctx context.Context, project string) ([]*fleet.Scope, error) {
-	var ret []*fleet.Scope
-	parent := fmt.Sprintf("projects/%s/locations/global", project)
-	call := c.svc.Projects.Locations.Scopes.List(parent)
-	err := call.Pages(ctx, func(resp *fleet.ListScopesResponse) error {
-		ret = append(ret, resp.Scopes...)
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	return ret, nil
-}
-
-// listMembershipBindings fetches the membership bindings under a given parent.
-func (c *FleetSync) listMembershipBindings(ctx context.Context, project string) ([]*fleet.MembershipBinding, error) {
-	var ret []*fleet.MembershipBinding
-	parent := fmt.Sprintf("projects/%s/locations/-/memberships/-", project)
-	call := c.svc.Projects.Locations.Memberships.Bindings.List(parent)
-	err := call.Pages(ctx, func(resp *fleet.ListMembershipBindingsResponse) error {
-		// Halt reconciliation on unreachable regions (which may be transient) to prevent an incomplete list from triggering unintended deletions (Issue #113).
-		if len(resp.Unreachable) > 0 {
-			return fmt.Errorf("fleet API ListMembershipBindings reported unreachable region(s): %v. Halting to prevent unintended deletions", resp.Unreachable)
-		}
-		ret = append(ret, resp.MembershipBindings...)
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	return ret, nil
-}
@@ -0,0 +1,1751 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"fleet-management-tools/argocd-sync/fakehub"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	container "google.golang.org/api/container/v1"
+	fleet "google.golang.org/api/gkehub/v1"
+	"google.golang.org/api/googleapi"
+	pubsub "google.golang.org/api/pubsub/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testProject = "123456"
+
+func testFleet() fakehub.Fleet {
+	return fakehub.Fleet{
+		Memberships: []*fleet.Membership{
+			{
+				Name:   "projects/123456/locations/us-central1/memberships/us-prod",
+				Labels: map[string]string{"env": "prod"},
+				State:  &fleet.MembershipState{Code: "READY"},
+				Endpoint: &fleet.MembershipEndpoint{
+					GkeCluster:         &fleet.GkeCluster{ResourceLink: "//container.googleapis.com/projects/p/locations/us-central1/clusters/us-prod"},
+					KubernetesMetadata: &fleet.KubernetesMetadata{KubernetesApiServerVersion: "v1.30.5"},
+				},
+			},
+			{
+				Name:   "projects/123456/locations/europe-west1/memberships/eu-prod",
+				Labels: map[string]string{"env": "prod"},
+				State:  &fleet.MembershipState{Code: "READY"},
+			},
+			{
+				Name:   "projects/123456/locations/europe-west1/memberships/eu-dev",
+				Labels: map[string]string{"env": "dev"},
+				State:  &fleet.MembershipState{Code: "READY"},
+			},
+		},
+		Scopes: []*fleet.Scope{
+			{Name: "projects/123456/locations/global/scopes/frontend"},
+			{Name: "projects/123456/locations/global/scopes/empty"},
+		},
+		Namespaces: []*fleet.Namespace{
+			{
+				Name:            "projects/123456/locations/global/scopes/frontend/namespaces/web",
+				NamespaceLabels: map[string]string{"team": "frontend"},
+			},
+			{Name: "projects/123456/locations/global/scopes/frontend/namespaces/api"},
+		},
+		Bindings: []*fleet.MembershipBinding{
+			{
+				Name:  "projects/123456/locations/us-central1/memberships/us-prod/bindings/frontend",
+				Scope: "projects/123456/locations/global/scopes/frontend",
+			},
+			{
+				Name:  "projects/123456/locations/europe-west1/memberships/eu-dev/bindings/frontend",
+				Scope: "projects/123456/locations/global/scopes/frontend",
+			},
+		},
+		Features: []*fleet.Feature{
+			{
+				Name: "projects/123456/locations/global/features/configmanagement",
+				MembershipStates: map[string]fleet.MembershipFeatureState{
+					"projects/123456/locations/us-central1/memberships/us-prod":  {State: &fleet.FeatureState{Code: "OK"}},
+					"projects/123456/locations/europe-west1/memberships/eu-prod": {State: &fleet.FeatureState{Code: "ERROR", Description: "sync failed"}},
+				},
+			},
+		},
+	}
+}
+
+// newTestFleetSync returns a FleetSync of the fake GKE Hub server, paginating one resource at a time, without
+// reconciling cluster secrets.
+func newTestFleetSync(t *testing.T, hub *fakehub.Server) *FleetSync {
+	t.Helper()
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c, err := NewFleetSync(ctx, testProject, Options{
+		RefreshInterval:   time.Hour,
+		Endpoint:          srv.URL + "/",
+		ContainerEndpoint: srv.URL + "/",
+		DisableSecrets:    true,
+	})
+	if err != nil {
+		t.Fatalf("NewFleetSync() failed: %v", err)
+	}
+	return c
+}
+
+func resultNames(results []Result) []string {
+	names := []string{}
+	for _, r := range results {
+		name := r.NameShort
+		if r.Namespace != "" {
+			name += "/" + r.Namespace
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPluginResults(t *testing.T) {
+	c := newTestFleetSync(t, fakehub.NewServer(testFleet(), 1))
+
+	testCases := []struct {
+		name      string
+		scopeID   string
+		selector  Selector
+		wantNames []string
+		wantErr   error
+	}{
+		{
+			name:      "all_memberships",
+			wantNames: []string{"eu-dev", "eu-prod", "us-prod"},
+		},
+		{
+			name:      "scope",
+			scopeID:   "frontend",
+			wantNames: []string{"eu-dev", "us-prod"},
+		},
+		{
+			name:      "scope_without_memberships",
+			scopeID:   "empty",
+			wantNames: []string{},
+		},
+		{
+			name:    "unknown_scope",
+			scopeID: "unknown",
+			wantErr: ErrUnknownScope,
+		},
+		{
+			name:      "label_selector",
+			selector:  Selector{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}}},
+			wantNames: []string{"eu-prod", "us-prod"},
+		},
+		{
+			name:      "locations_within_scope",
+			scopeID:   "frontend",
+			selector:  Selector{Locations: []string{"europe-west1"}},
+			wantNames: []string{"eu-dev"},
+		},
+		{
+			name:      "exclude_locations",
+			selector:  Selector{ExcludeLocations: []string{"europe-west1"}},
+			wantNames: []string{"us-prod"},
+		},
+		{
+			name:      "name_patterns",
+			selector:  Selector{NamePatterns: []string{"^eu-", "^nope$"}},
+			wantNames: []string{"eu-dev", "eu-prod"},
+		},
+		{
+			name:      "feature_enabled",
+			selector:  Selector{Features: map[string]string{"configmanagement": ""}},
+			wantNames: []string{"eu-prod", "us-prod"},
+		},
+		{
+			name:      "feature_state",
+			selector:  Selector{Features: map[string]string{"configmanagement": "OK"}},
+			wantNames: []string{"us-prod"},
+		},
+		{
+			name:      "feature_not_enabled",
+			selector:  Selector{Features: map[string]string{"servicemesh": ""}},
+			wantNames: []string{},
+		},
+		{
+			name:     "invalid_name_pattern",
+			selector: Selector{NamePatterns: []string{"("}},
+			wantErr:  ErrInvalidRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := c.PluginResults(context.Background(), tc.scopeID, tc.selector)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("PluginResults() error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			if got := resultNames(results); !slices.Equal(got, tc.wantNames) {
+				t.Errorf("PluginResults() = %v, want %v", got, tc.wantNames)
+			}
+		})
+	}
+}
+
+func TestResultMetadata(t *testing.T) {
+	c := newTestFleetSync(t, fakehub.NewServer(testFleet(), 0))
+
+	results, err := c.PluginResults(context.Background(), "", Selector{NamePatterns: []string{"us-prod"}})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("PluginResults() = %v, %v, want one result", results, err)
+	}
+	r := results[0]
+	if r.ServerURL != "https://us-central1-connectgateway.googleapis.com/v1/projects/123456/locations/us-central1/gkeMemberships/us-prod" {
+		t.Errorf("ServerURL = %q", r.ServerURL)
+	}
+	if r.Name != "us-prod.us-central1.123456" || r.Location != "us-central1" || r.Project != testProject {
+		t.Errorf("Name, Location, Project = %q, %q, %q", r.Name, r.Location, r.Project)
+	}
+	if r.Scopes != "frontend" || r.KubernetesVersion != "v1.30.5" || r.ClusterResourceLink == "" {
+		t.Errorf("Scopes, KubernetesVersion, ClusterResourceLink = %q, %q, %q", r.Scopes, r.KubernetesVersion, r.ClusterResourceLink)
+	}
+	if r.Metadata.Labels["env"] != "prod" {
+		t.Errorf("Metadata.Labels = %v", r.Metadata.Labels)
+	}
+	if got := flatParams(r)["features.configmanagement.state"]; got != "OK" {
+		t.Errorf("features.configmanagement.state = %q, want OK", got)
+	}
+}
+
+func TestSelectorValidate(t *testing.T) {
+	var valid Selector
+	if err := json.Unmarshal([]byte(`{
+		"labelSelector": {"matchExpressions": [{"key": "env", "operator": "In", "values": ["prod"]}]},
+		"locations": ["us-central1"],
+		"excludeLocations": ["global"],
+		"namePatterns": ["^us-"],
+		"features": {"configmanagement": "OK"}
+	}`), &valid); err != nil {
+		t.Fatalf("json.Unmarshal() failed: %v", err)
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+	if len(valid.Locations) != 1 || len(valid.ExcludeLocations) != 1 || len(valid.NamePatterns) != 1 || len(valid.Features) != 1 {
+		t.Errorf("decoded Selector = %+v", valid)
+	}
+
+	for name, invalid := range map[string]Selector{
+		"unknown_operator": {LabelSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "env", Operator: "Near"}}}},
+		"invalid_label":    {LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "not valid"}}},
+		"invalid_pattern":  {NamePatterns: []string{"us-[a"}},
+	} {
+		if err := invalid.Validate(); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("Validate() of %s selector = %v, want %v", name, err, ErrInvalidRequest)
+		}
+	}
+}
+
+func TestResultParameters(t *testing.T) {
+	c := newTestFleetSync(t, fakehub.NewServer(testFleet(), 0))
+
+	results, err := c.PluginResults(context.Background(), "frontend", Selector{NamePatterns: []string{"us-prod"}})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("PluginResults() = %v, %v, want one result", results, err)
+	}
+	data, err := json.Marshal(results[0])
+	if err != nil {
+		t.Fatalf("json.Marshal() failed: %v", err)
+	}
+	// The generator parameters of Argo CD are the keys of the JSON result, flattened with dots.
+	var params map[string]any
+	if err := json.Unmarshal(data, &params); err != nil {
+		t.Fatalf("json.Unmarshal() failed: %v", err)
+	}
+	for key, want := range map[string]any{
+		"name":                "us-prod.us-central1.123456",
+		"nameShort":           "us-prod",
+		"location":            "us-central1",
+		"project":             testProject,
+		"scopes":              "frontend",
+		"kubernetesVersion":   "v1.30.5",
+		"clusterResourceLink": "//container.googleapis.com/projects/p/locations/us-central1/clusters/us-prod",
+	} {
+		if params[key] != want {
+			t.Errorf("parameter %s = %v, want %v", key, params[key], want)
+		}
+	}
+	md, _ := params["metadata"].(map[string]any)
+	if labels, _ := md["labels"].(map[string]any); labels["env"] != "prod" {
+		t.Errorf("parameter metadata.labels = %v, want env: prod", md["labels"])
+	}
+	if scopes, _ := md["scopes"].([]any); len(scopes) != 1 || scopes[0] != "frontend" {
+		t.Errorf("parameter metadata.scopes = %v, want [frontend]", md["scopes"])
+	}
+	if _, ok := params["namespace"]; ok {
+		t.Error("parameter namespace is set outside of per-namespace results")
+	}
+}
+
+func TestNamespaceResults(t *testing.T) {
+	c := newTestFleetSync(t, fakehub.NewServer(testFleet(), 1))
+
+	results, err := c.NamespaceResults(context.Background(), "frontend", Selector{})
+	if err != nil {
+		t.Fatalf("NamespaceResults() failed: %v", err)
+	}
+	want := []string{"eu-dev/api", "eu-dev/web", "us-prod/api", "us-prod/web"}
+	if got := resultNames(results); !slices.Equal(got, want) {
+		t.Errorf("NamespaceResults() = %v, want %v", got, want)
+	}
+	for _, r := range results {
+		if r.Namespace == "web" && r.Metadata.NamespaceLabels["team"] != "frontend" {
+			t.Errorf("Metadata.NamespaceLabels of %s = %v", r.Name, r.Metadata.NamespaceLabels)
+		}
+	}
+
+	if _, err := c.NamespaceResults(context.Background(), "", Selector{}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("NamespaceResults() without scope error = %v, want %v", err, ErrInvalidRequest)
+	}
+	if _, err := c.NamespaceResults(context.Background(), "unknown", Selector{}); !errors.Is(err, ErrUnknownScope) {
+		t.Errorf("NamespaceResults() of an unknown scope error = %v, want %v", err, ErrUnknownScope)
+	}
+
+	// The selector filters the memberships, and scopes without fleet namespaces have no results.
+	results, err = c.NamespaceResults(context.Background(), "frontend", Selector{Locations: []string{"us-central1"}})
+	if want := []string{"us-prod/api", "us-prod/web"}; err != nil || !slices.Equal(resultNames(results), want) {
+		t.Errorf("NamespaceResults() with selector = %v, %v, want %v", resultNames(results), err, want)
+	}
+	if results, err := c.NamespaceResults(context.Background(), "empty", Selector{}); err != nil || len(results) != 0 {
+		t.Errorf("NamespaceResults() of a scope without namespaces = %v, %v, want no results", resultNames(results), err)
+	}
+	for _, r := range results {
+		if r.Metadata.Namespace != r.Namespace {
+			t.Errorf("Metadata.Namespace of %s = %q, want %q", r.Name, r.Metadata.Namespace, r.Namespace)
+		}
+	}
+}
+
+func TestApplyValues(t *testing.T) {
+	c := newTestFleetSync(t, fakehub.NewServer(testFleet(), 0))
+
+	results, err := c.PluginResults(context.Background(), "frontend", Selector{Locations: []string{"us-central1"}})
+	if err != nil {
+		t.Fatalf("PluginResults() failed: %v", err)
+	}
+	results = ApplyValues(results, map[string]any{
+		"replicas": "replicas-{{location}}",
+		"nested":   map[string]any{"env": "{{ metadata.labels.env }}-{{unknown}}"},
+		"count":    float64(3),
+	})
+	values := results[0].Values
+	if got := values["replicas"]; got != "replicas-us-central1" {
+		t.Errorf("values.replicas = %v, want replicas-us-central1", got)
+	}
+	if got := values["nested"].(map[string]any)["env"]; got != "prod-{{unknown}}" {
+		t.Errorf("values.nested.env = %v, want prod-{{unknown}}", got)
+	}
+	if got := values["count"]; got != float64(3) {
+		t.Errorf("values.count = %v, want 3", got)
+	}
+}
+
+func TestApplyWaves(t *testing.T) {
+	f := testFleet()
+	f.Memberships[0].Labels["wave"] = "2"
+	f.Memberships[1].Labels["wave"] = "invalid"
+	c := newTestFleetSync(t, fakehub.NewServer(f, 0))
+	results, err := c.PluginResults(context.Background(), "", Selector{})
+	if err != nil {
+		t.Fatalf("PluginResults() failed: %v", err)
+	}
+	one := 1
+
+	testCases := []struct {
+		name      string
+		policy    *WavePolicy
+		maxWave   *int
+		wantNames []string
+		wantWaves []int
+	}{
+		{
+			name:      "no_policy",
+			wantNames: []string{"eu-dev", "eu-prod", "us-prod"},
+			wantWaves: []int{0, 0, 0},
+		},
+		{
+			name:      "label",
+			policy:    &WavePolicy{Label: "wave", Default: 1},
+			wantNames: []string{"eu-dev", "eu-prod", "us-prod"},
+			wantWaves: []int{1, 1, 2},
+		},
+		{
+			name:      "locations",
+			policy:    &WavePolicy{Locations: [][]string{{"us-central1"}}},
+			wantNames: []string{"us-prod", "eu-dev", "eu-prod"},
+			wantWaves: []int{0, 1, 1},
+		},
+		{
+			name:      "max_wave",
+			policy:    &WavePolicy{Label: "wave", Default: 1},
+			maxWave:   &one,
+			wantNames: []string{"eu-dev", "eu-prod"},
+			wantWaves: []int{1, 1},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ApplyWaves(results, tc.policy, tc.maxWave)
+			var names []string
+			var waves []int
+			for _, r := range got {
+				names = append(names, r.NameShort)
+				waves = append(waves, r.Wave)
+			}
+			if !slices.Equal(names, tc.wantNames) || !slices.Equal(waves, tc.wantWaves) {
+				t.Errorf("ApplyWaves() = %v in waves %v, want %v in waves %v", names, waves, tc.wantNames, tc.wantWaves)
+			}
+		})
+	}
+
+	// Hashed waves are stable and within the buckets.
+	policy := &WavePolicy{Buckets: 2}
+	first := ApplyWaves(results, policy, nil)
+	if second := ApplyWaves(results, policy, nil); !slices.EqualFunc(first, second, func(a, b Result) bool { return a.Name == b.Name && a.Wave == b.Wave }) {
+		t.Errorf("ApplyWaves() with buckets is not deterministic")
+	}
+	for _, r := range first {
+		if r.Wave < 0 || r.Wave >= 2 {
+			t.Errorf("wave of %s = %d, want within 2 buckets", r.NameShort, r.Wave)
+		}
+	}
+
+	for name, p := range map[string]*WavePolicy{
+		"none":             {},
+		"several":          {Label: "wave", Buckets: 2},
+		"negative_buckets": {Buckets: -1},
+	} {
+		if err := p.Validate(); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("Validate() of %s policy = %v, want %v", name, err, ErrInvalidRequest)
+		}
+	}
+}
+
+func TestRefreshUnreachableKeepsLastKnownGood(t *testing.T) {
+	hub := fakehub.NewServer(testFleet(), 0)
+	c := newTestFleetSync(t, hub)
+
+	// europe-west1 is unreachable, while us-prod is unbound from its scope.
+	f := testFleet()
+	f.Bindings = f.Bindings[1:]
+	f.Unreachable = []string{"europe-west1"}
+	hub.SetFleet(f)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	results, err := c.PluginResults(context.Background(), "", Selector{})
+	if want := []string{"eu-dev", "eu-prod", "us-prod"}; err != nil || !slices.Equal(resultNames(results), want) {
+		t.Errorf("PluginResults() = %v, %v, want %v", resultNames(results), err, want)
+	}
+	results, err = c.PluginResults(context.Background(), "frontend", Selector{})
+	if want := []string{"eu-dev"}; err != nil || !slices.Equal(resultNames(results), want) {
+		t.Errorf("PluginResults() of scope = %v, %v, want the updated us-central1 and last-known-good europe-west1 %v", resultNames(results), err, want)
+	}
+
+	// Once reachable again, the location is updated.
+	f.Memberships = f.Memberships[:2]
+	f.Unreachable = nil
+	hub.SetFleet(f)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	results, err = c.PluginResults(context.Background(), "", Selector{})
+	if want := []string{"eu-prod", "us-prod"}; err != nil || !slices.Equal(resultNames(results), want) {
+		t.Errorf("PluginResults() = %v, %v, want %v", resultNames(results), err, want)
+	}
+}
+
+// slowBackend is a Backend whose scope list calls block until their deadline.
+type slowBackend struct {
+	Backend
+}
+
+func (slowBackend) ListScopes(ctx context.Context, _ string) ([]*fleet.Scope, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// failingFeaturesBackend is a Backend whose feature list calls fail.
+type failingFeaturesBackend struct {
+	Backend
+}
+
+func (failingFeaturesBackend) ListFeatures(context.Context, string) ([]*fleet.Feature, error) {
+	return nil, &googleapi.Error{Code: http.StatusForbidden}
+}
+
+func TestRefreshFeaturesError(t *testing.T) {
+	c := newTestFleetSync(t, fakehub.NewServer(testFleet(), 0))
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+
+	// A failed feature list keeps the last-known feature states, without failing the refresh.
+	c.backend = failingFeaturesBackend{c.backend}
+	before := testutil.ToFloat64(featureListErrors.WithLabelValues(testProject))
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if got := testutil.ToFloat64(featureListErrors.WithLabelValues(testProject)) - before; got != 1 {
+		t.Errorf("feature list errors = %v, want 1", got)
+	}
+	results, err := c.PluginResults(context.Background(), "", Selector{NamePatterns: []string{"us-prod"}})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("PluginResults() = %v, %v, want one result", results, err)
+	}
+	if got := flatParams(results[0])["features.configmanagement.state"]; got != "OK" {
+		t.Errorf("features.configmanagement.state = %q, want the last-known OK", got)
+	}
+}
+
+func TestRefreshAPITimeout(t *testing.T) {
+	c := newTestFleetSync(t, fakehub.NewServer(testFleet(), 0))
+	c.backend = slowBackend{c.backend}
+	c.apiTimeout = 50 * time.Millisecond
+	if err := c.Refresh(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Refresh() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// testSpans records the spans of the tests. The tracer of the package only delegates to the first global
+// TracerProvider, so it is set once.
+var testSpans = sync.OnceValue(func() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder
+})
+
+func TestRefreshTracing(t *testing.T) {
+	recorder := testSpans()
+	c := newTestFleetSync(t, fakehub.NewServer(testFleet(), 1))
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	var refresh trace.SpanContext
+	pages := make(map[string]int)
+	spans := recorder.Ended()
+	for _, span := range spans {
+		if span.Name() == "FleetSync.Refresh" {
+			refresh = span.SpanContext()
+		}
+	}
+	for _, span := range spans {
+		if strings.HasPrefix(span.Name(), "fleetapi.") && span.Parent().SpanID() == refresh.SpanID() {
+			pages[span.Name()]++
+		}
+	}
+	// One span per page of one resource.
+	if got, want := pages["fleetapi.ListMemberships"], len(testFleet().Memberships); got != want {
+		t.Errorf("got %d ListMemberships page spans in the refresh, want %d", got, want)
+	}
+	if got, want := pages["fleetapi.ListMembershipBindings"], len(testFleet().Bindings); got != want {
+		t.Errorf("got %d ListMembershipBindings page spans in the refresh, want %d", got, want)
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	c := &FleetSync{refreshInterval: 10 * time.Second, maxBackoff: time.Minute}
+	for failures, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+		for range 10 {
+			got := c.refreshDelay(failures)
+			if failures == 0 && got != want || got < want/2 || got > want {
+				t.Errorf("refreshDelay(%d) = %v, want %v with jitter", failures, got, want)
+			}
+		}
+	}
+	if got := c.refreshDelay(100); got > time.Minute {
+		t.Errorf("refreshDelay(100) = %v, want at most %v", got, time.Minute)
+	}
+
+	// Long outages back off at the maximum, without overflowing the doubled interval, with the default interval and
+	// the one of change notifications.
+	for _, interval := range []time.Duration{10 * time.Second, 5 * time.Minute} {
+		c := &FleetSync{refreshInterval: interval, maxBackoff: 5 * time.Minute}
+		for failures := 1; failures <= 64; failures++ {
+			want := time.Duration(min(math.Ldexp(float64(interval), failures), float64(c.maxBackoff)))
+			if got := c.refreshDelay(failures); got < want/2 || got > want {
+				t.Errorf("refreshDelay(%d) with interval %v = %v, want %v with jitter", failures, interval, got, want)
+			}
+		}
+	}
+	r := &Registry{opts: Options{RefreshInterval: 5 * time.Minute}}
+	for failures := 1; failures <= 64; failures++ {
+		if got := r.retryDelay(failures); got <= 0 || got > 5*time.Minute {
+			t.Errorf("retryDelay(%d) = %v, want at most %v", failures, got, 5*time.Minute)
+		}
+	}
+
+	if !isQuotaError(fmt.Errorf("failed to list memberships: %w", &googleapi.Error{Code: 429})) {
+		t.Error("isQuotaError() = false for HTTP 429, want true")
+	}
+}
+
+func TestTriggerRefresh(t *testing.T) {
+	hub := fakehub.NewServer(testFleet(), 0)
+	c := newTestFleetSync(t, hub)
+	f := testFleet()
+	f.Memberships = f.Memberships[:1]
+	hub.SetFleet(f)
+
+	c.TriggerRefresh()
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		results, err := c.PluginResults(ctx, "", Selector{})
+		return err == nil && len(results) == 1, nil
+	})
+	if err != nil {
+		t.Errorf("PluginResults() did not reflect the triggered refresh: %v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	srv := httptest.NewServer(fakehub.NewServer(testFleet(), 0))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewRegistry(ctx, []string{testProject, "654321"}, Options{Endpoint: srv.URL + "/", ContainerEndpoint: srv.URL + "/", DisableSecrets: true})
+
+	if _, err := r.Get("999999"); !errors.Is(err, ErrProjectNotAllowed) {
+		t.Errorf("Get() of a project outside of the allow-list error = %v, want %v", err, ErrProjectNotAllowed)
+	}
+	if len(r.FleetSyncs()) != 0 {
+		t.Errorf("FleetSyncs() = %v before any request, want none", r.FleetSyncs())
+	}
+	c, err := r.Get(testProject)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	if again, _ := r.Get(testProject); again != c {
+		t.Error("Get() created a second FleetSync of the same project")
+	}
+	if c.ProjectNum != testProject {
+		t.Errorf("ProjectNum = %q, want %q", c.ProjectNum, testProject)
+	}
+	if got := r.FleetSyncs(); len(got) != 1 || got[testProject] != c {
+		t.Errorf("FleetSyncs() = %v, want only the requested project", got)
+	}
+}
+
+// blockingBackend is a Backend whose membership list calls of the blocked project wait for unblock, then fail.
+type blockingBackend struct {
+	Backend
+	blocked string
+	unblock chan struct{}
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (b *blockingBackend) ListMemberships(ctx context.Context, project string) ([]*fleet.Membership, []string, error) {
+	if project != b.blocked {
+		return b.Backend.ListMemberships(ctx, project)
+	}
+	b.mu.Lock()
+	b.calls++
+	b.mu.Unlock()
+	<-b.unblock
+	return nil, nil, errors.New("unavailable")
+}
+
+func (b *blockingBackend) blockedCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls
+}
+
+func TestRegistrySharesInformers(t *testing.T) {
+	srv := httptest.NewServer(fakehub.NewServer(testFleet(), 0))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kube := fake.NewClientset()
+	dyn := newFakeDynamicClient()
+	r := NewRegistry(ctx, []string{testProject, "789012"}, Options{
+		RefreshInterval:   time.Hour,
+		Endpoint:          srv.URL + "/",
+		ContainerEndpoint: srv.URL + "/",
+		KubeClient:        kube,
+		DynamicClient:     dyn,
+		AppProjects:       &AppProjectOptions{},
+	})
+	c1, err := r.Get(testProject)
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", testProject, err)
+	}
+	c2, err := r.Get("789012")
+	if err != nil {
+		t.Fatalf("Get(789012) failed: %v", err)
+	}
+
+	// Both fleets list and watch the cluster secrets and AppProjects once.
+	count := func(actions []k8stesting.Action, verb, resource string) int {
+		n := 0
+		for _, a := range actions {
+			if a.GetVerb() == verb && a.GetResource().Resource == resource {
+				n++
+			}
+		}
+		return n
+	}
+	if list, watch := count(kube.Actions(), "list", "secrets"), count(kube.Actions(), "watch", "secrets"); list != 1 || watch != 1 {
+		t.Errorf("secrets listed %d and watched %d times, want once", list, watch)
+	}
+	if list, watch := count(dyn.Actions(), "list", "appprojects"), count(dyn.Actions(), "watch", "appprojects"); list != 1 || watch != 1 {
+		t.Errorf("AppProjects listed %d and watched %d times, want once", list, watch)
+	}
+	if c1.secrets.secretCache != c2.secrets.secretCache || c1.appProjects.appProjectCache != c2.appProjects.appProjectCache {
+		t.Error("the FleetSyncs of a Registry do not share the informer caches")
+	}
+	// Each fleet keeps its own prune tombstones.
+	if c1.secrets == c2.secrets || c1.appProjects == c2.appProjects {
+		t.Error("the FleetSyncs of a Registry share their reconcilers")
+	}
+
+	// A refresh of the empty fleet does not prune the secrets of the other fleet from the shared cache.
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		cached, err := c2.secrets.lister.List(labels.Everything())
+		return len(cached) > 0, err
+	})
+	if err != nil {
+		t.Fatalf("the shared cache has no cluster secrets of project %s", testProject)
+	}
+	if err := c2.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if count(kube.Actions(), "delete", "secrets") != 0 {
+		t.Error("a refresh of fleet 789012 deleted cluster secrets of another fleet")
+	}
+}
+
+func TestRegistryConcurrentCreation(t *testing.T) {
+	srv := httptest.NewServer(fakehub.NewServer(testFleet(), 0))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api, err := NewBackend(ctx, srv.URL+"/", srv.URL+"/")
+	if err != nil {
+		t.Fatalf("NewBackend() failed: %v", err)
+	}
+	backend := &blockingBackend{Backend: api, blocked: "654321", unblock: make(chan struct{})}
+	r := NewRegistry(ctx, []string{testProject, "654321"}, Options{Backend: backend, DisableSecrets: true})
+
+	blockedErr := make(chan error)
+	go func() {
+		_, err := r.Get("654321")
+		blockedErr <- err
+	}()
+	if err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		return backend.blockedCalls() == 1, nil
+	}); err != nil {
+		t.Fatal("the initial refresh of the blocked project did not start")
+	}
+
+	// The slow creation of a project blocks neither the other projects nor the readiness of the Registry.
+	if _, err := r.Get(testProject); err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	if stale := r.Stale(time.Hour); len(stale) != 0 {
+		t.Errorf("Stale() = %v, want none", stale)
+	}
+
+	close(backend.unblock)
+	if err := <-blockedErr; !errors.Is(err, ErrNotSynced) {
+		t.Fatalf("Get() of the failing project error = %v, want %v", err, ErrNotSynced)
+	}
+	// The failure is cached until its retry time.
+	if _, err := r.Get("654321"); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("Get() of the failing project error = %v, want %v", err, ErrNotSynced)
+	}
+	if calls := backend.blockedCalls(); calls != 1 {
+		t.Errorf("the failing project was refreshed %d times, want once before its retry time", calls)
+	}
+	if got := r.FleetSyncs(); len(got) != 1 {
+		t.Errorf("FleetSyncs() = %v, want only %s", got, testProject)
+	}
+}
+
+func TestRegistryWait(t *testing.T) {
+	srv := httptest.NewServer(fakehub.NewServer(testFleet(), 0))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewRegistry(ctx, []string{testProject}, Options{Endpoint: srv.URL + "/", ContainerEndpoint: srv.URL + "/", DisableSecrets: true})
+	if _, err := r.Get(testProject); err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+
+	cancel()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if err := r.Wait(waitCtx); err != nil {
+		t.Errorf("Wait() = %v, want the reconciliation stopped", err)
+	}
+}
+
+// fakePubSub serves the pull and acknowledge methods of a Pub/Sub subscription, delivering messages once.
+type fakePubSub struct {
+	mu       sync.Mutex
+	messages []*pubsub.ReceivedMessage
+	acked    []string
+}
+
+func (f *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, ":pull"):
+		if len(f.messages) == 0 {
+			// Pub/Sub holds pulls open for a while without messages.
+			f.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			f.mu.Lock()
+		}
+		_ = json.NewEncoder(w).Encode(pubsub.PullResponse{ReceivedMessages: f.messages})
+		f.messages = nil
+	case strings.HasSuffix(r.URL.Path, ":acknowledge"):
+		var req pubsub.AcknowledgeRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.acked = append(f.acked, req.AckIds...)
+		_, _ = w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func notification(t *testing.T, ackID, n string) *pubsub.ReceivedMessage {
+	t.Helper()
+	return &pubsub.ReceivedMessage{AckId: ackID, Message: &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString([]byte(n))}}
+}
+
+func TestSubscriber(t *testing.T) {
+	hub := fakehub.NewServer(testFleet(), 0)
+	hubSrv := httptest.NewServer(hub)
+	defer hubSrv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewRegistry(ctx, []string{testProject}, Options{RefreshInterval: time.Hour, Endpoint: hubSrv.URL + "/", ContainerEndpoint: hubSrv.URL + "/", DisableSecrets: true})
+	c, err := r.Get(testProject)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	f := testFleet()
+	f.Memberships = f.Memberships[:1]
+	hub.SetFleet(f)
+
+	ps := &fakePubSub{messages: []*pubsub.ReceivedMessage{
+		notification(t, "other", `{"asset": {"name": "//compute.googleapis.com/projects/123456/zones/us-east1-b/instances/vm", "assetType": "compute.googleapis.com/Instance"}}`),
+		notification(t, "invalid", `not json`),
+		notification(t, "membership", `{"asset": {"name": "//gkehub.googleapis.com/projects/my-project/locations/us-east1/memberships/us-prod", "assetType": "gkehub.googleapis.com/Membership", "ancestors": ["projects/123456", "organizations/1"]}}`),
+	}}
+	psSrv := httptest.NewServer(ps)
+	defer psSrv.Close()
+	s, err := NewSubscriber(ctx, "projects/p/subscriptions/fleet-changes", psSrv.URL+"/", r)
+	if err != nil {
+		t.Fatalf("NewSubscriber() failed: %v", err)
+	}
+	go s.Run(ctx)
+
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		results, err := c.PluginResults(ctx, "", Selector{})
+		return err == nil && len(results) == 1, nil
+	})
+	if err != nil {
+		t.Errorf("PluginResults() did not reflect the notified change: %v", err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		return len(ps.acked) == 3, nil
+	})
+	if err != nil {
+		t.Errorf("got acknowledged %v, want every notification acknowledged", ps.acked)
+	}
+}
+
+func TestAssetProject(t *testing.T) {
+	for _, tc := range []struct {
+		asset asset
+		want  string
+	}{
+		{asset{Name: "//gkehub.googleapis.com/projects/my-project/locations/global/scopes/s", Ancestors: []string{"projects/123456", "folders/1"}}, "123456"},
+		{asset{Name: "//gkehub.googleapis.com/projects/123456/locations/global/scopes/s"}, "123456"},
+		{asset{Name: "//gkehub.googleapis.com/projects/my-project/locations/global/scopes/s"}, ""},
+	} {
+		if got := assetProject(&tc.asset); got != tc.want {
+			t.Errorf("assetProject(%s) = %q, want %q", tc.asset.Name, got, tc.want)
+		}
+	}
+}
+
+func TestMembershipStates(t *testing.T) {
+	f := testFleet()
+	f.Memberships = append(f.Memberships, &fleet.Membership{
+		Name:  "projects/123456/locations/us-east1/memberships/new",
+		State: &fleet.MembershipState{Code: "CREATING"},
+	})
+	hub := fakehub.NewServer(f, 0)
+	c := newTestFleetSync(t, hub)
+	c.stateGracePeriod = time.Hour
+
+	results, err := c.PluginResults(context.Background(), "", Selector{})
+	if want := []string{"eu-dev", "eu-prod", "us-prod"}; err != nil || !slices.Equal(resultNames(results), want) {
+		t.Errorf("PluginResults() = %v, %v, want %v", resultNames(results), err, want)
+	}
+	excluded := c.ExcludedMemberships()
+	if len(excluded) != 1 || excluded[0].State != "CREATING" || excluded[0].LastIncluded != nil {
+		t.Errorf("ExcludedMemberships() = %+v, want the CREATING membership", excluded)
+	}
+
+	// A previously ready membership is kept during the grace period.
+	f.Memberships[0].State.Code = "DELETING"
+	hub.SetFleet(f)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	results, _ = c.PluginResults(context.Background(), "frontend", Selector{})
+	if want := []string{"eu-dev", "us-prod"}; !slices.Equal(resultNames(results), want) {
+		t.Errorf("PluginResults() within grace period = %v, want %v", resultNames(results), want)
+	}
+
+	// And dropped after.
+	c.stateGracePeriod = 0
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	results, _ = c.PluginResults(context.Background(), "frontend", Selector{})
+	if want := []string{"eu-dev"}; !slices.Equal(resultNames(results), want) {
+		t.Errorf("PluginResults() after grace period = %v, want %v", resultNames(results), want)
+	}
+	if excluded := c.ExcludedMemberships(); len(excluded) != 2 || excluded[0].LastIncluded == nil {
+		t.Errorf("ExcludedMemberships() = %+v, want the CREATING and DELETING memberships", excluded)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	f := testFleet()
+	f.Memberships[0].Labels["endpoint"] = "dns"
+	f.Memberships[1].Labels["endpoint"] = "connectgateway"
+	f.Clusters = map[string]*container.Cluster{
+		"projects/p/locations/us-central1/clusters/us-prod": {
+			ControlPlaneEndpointsConfig: &container.ControlPlaneEndpointsConfig{
+				DnsEndpointConfig: &container.DNSEndpointConfig{Endpoint: "gke-0123.us-central1.gke.goog"},
+			},
+		},
+	}
+	hub := fakehub.NewServer(f, 0)
+	c := newTestFleetSync(t, hub)
+	var err error
+	c.endpoints, err = newEndpoints(EndpointOptions{
+		Default: "psc",
+		Label:   "endpoint",
+		Templates: map[string]string{
+			"psc": "https://connectgateway.example.internal/v1/projects/{{.ProjectNum}}/locations/{{.Location}}/gkeMemberships/{{.MembershipID}}",
+		},
+	})
+	if err != nil {
+		t.Fatalf("newEndpoints() failed: %v", err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+
+	results, err := c.PluginResults(context.Background(), "", Selector{})
+	if err != nil {
+		t.Fatalf("PluginResults() failed: %v", err)
+	}
+	got := make(map[string]string)
+	for _, r := range results {
+		got[r.NameShort] = r.ServerURL
+	}
+	want := map[string]string{
+		"us-prod": "https://gke-0123.us-central1.gke.goog",
+		"eu-prod": "https://europe-west1-connectgateway.googleapis.com/v1/projects/123456/locations/europe-west1/gkeMemberships/eu-prod",
+		"eu-dev":  "https://connectgateway.example.internal/v1/projects/123456/locations/europe-west1/gkeMemberships/eu-dev",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("server URLs = %v, want %v", got, want)
+	}
+
+	// A failed DNS endpoint lookup keeps the last-known server URL of the membership, or falls back to Connect
+	// Gateway, without failing the refresh.
+	c.endpoints.dnsEndpoints = make(map[string]string)
+	f.Clusters = nil
+	f.Memberships[1].Labels["endpoint"] = "dns"
+	f.Memberships[1].Endpoint = &fleet.MembershipEndpoint{GkeCluster: &fleet.GkeCluster{ResourceLink: "//container.googleapis.com/projects/p/locations/europe-west1/clusters/eu-prod"}}
+	hub.SetFleet(f)
+	before := testutil.ToFloat64(endpointFallbacks.WithLabelValues(testProject))
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if got := testutil.ToFloat64(endpointFallbacks.WithLabelValues(testProject)) - before; got != 2 {
+		t.Errorf("endpoint fallbacks = %v, want 2", got)
+	}
+	results, err = c.PluginResults(context.Background(), "", Selector{})
+	if err != nil {
+		t.Fatalf("PluginResults() failed: %v", err)
+	}
+	clear(got)
+	for _, r := range results {
+		got[r.NameShort] = r.ServerURL
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("server URLs = %v, want the last-known %v", got, want)
+	}
+	c.mu.Lock()
+	c.ServerURLCache = nil
+	c.mu.Unlock()
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	results, _ = c.PluginResults(context.Background(), "", Selector{})
+	for _, r := range results {
+		if r.NameShort == "us-prod" && r.ServerURL != "https://us-central1-connectgateway.googleapis.com/v1/projects/123456/locations/us-central1/gkeMemberships/us-prod" {
+			t.Errorf("server URL of us-prod = %q, want its Connect Gateway URL", r.ServerURL)
+		}
+	}
+}
+
+func TestPruneDNSEndpoints(t *testing.T) {
+	f := testFleet()
+	f.Memberships[0].Labels["endpoint"] = "dns"
+	f.Clusters = map[string]*container.Cluster{
+		"projects/p/locations/us-central1/clusters/us-prod": {
+			ControlPlaneEndpointsConfig: &container.ControlPlaneEndpointsConfig{
+				DnsEndpointConfig: &container.DNSEndpointConfig{Endpoint: "gke-0123.us-central1.gke.goog"},
+			},
+		},
+	}
+	hub := fakehub.NewServer(f, 0)
+	c := newTestFleetSync(t, hub)
+	var err error
+	if c.endpoints, err = newEndpoints(EndpointOptions{Label: "endpoint"}); err != nil {
+		t.Fatalf("newEndpoints() failed: %v", err)
+	}
+	c.endpoints.dnsEndpoints["projects/p/locations/us-central1/clusters/deleted"] = "https://gke-4567.us-central1.gke.goog"
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	want := map[string]string{"projects/p/locations/us-central1/clusters/us-prod": "https://gke-0123.us-central1.gke.goog"}
+	if !maps.Equal(c.endpoints.dnsEndpoints, want) {
+		t.Errorf("dnsEndpoints = %v, want %v", c.endpoints.dnsEndpoints, want)
+	}
+
+	// The cluster of a deleted membership is forgotten.
+	f.Memberships = f.Memberships[1:]
+	hub.SetFleet(f)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if len(c.endpoints.dnsEndpoints) != 0 {
+		t.Errorf("dnsEndpoints = %v, want none", c.endpoints.dnsEndpoints)
+	}
+}
+
+func TestBackendEndpoints(t *testing.T) {
+	// The GKE Hub and GKE APIs are served by different hosts, eg. private endpoints.
+	f := testFleet()
+	hubSrv := httptest.NewServer(fakehub.NewServer(f, 0))
+	defer hubSrv.Close()
+	f.Clusters = map[string]*container.Cluster{
+		"projects/p/locations/us-central1/clusters/us-prod": {
+			ControlPlaneEndpointsConfig: &container.ControlPlaneEndpointsConfig{
+				DnsEndpointConfig: &container.DNSEndpointConfig{Endpoint: "gke-0123.us-central1.gke.goog"},
+			},
+		},
+	}
+	gkeSrv := httptest.NewServer(fakehub.NewServer(fakehub.Fleet{Clusters: f.Clusters}, 0))
+	defer gkeSrv.Close()
+
+	backend, err := NewBackend(context.Background(), hubSrv.URL+"/", gkeSrv.URL+"/")
+	if err != nil {
+		t.Fatalf("NewBackend() failed: %v", err)
+	}
+	if mems, _, err := backend.ListMemberships(context.Background(), testProject); err != nil || len(mems) != 3 {
+		t.Errorf("ListMemberships() = %d memberships, %v, want 3", len(mems), err)
+	}
+	if ep, err := backend.GetClusterDNSEndpoint(context.Background(), "projects/p/locations/us-central1/clusters/us-prod"); err != nil || ep != "gke-0123.us-central1.gke.goog" {
+		t.Errorf("GetClusterDNSEndpoint() = %q, %v, want the endpoint of the GKE API", ep, err)
+	}
+}
+
+func TestEndpointOptionsInvalid(t *testing.T) {
+	for name, opts := range map[string]EndpointOptions{
+		"unknown_default":   {Default: "psc"},
+		"overrides_builtin": {Templates: map[string]string{"dns": "https://example.com"}},
+		"not_https":         {Templates: map[string]string{"psc": "http://{{.MembershipID}}.example.com"}},
+		"malformed":         {Templates: map[string]string{"psc": "https://{{.MembershipID"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := ValidateEndpointOptions(opts); err == nil {
+				t.Error("ValidateEndpointOptions() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestParseSecretTemplate(t *testing.T) {
+	custom := `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{.Name}}
+  namespace: argocd
+  labels:
+    argocd.argoproj.io/secret-type: cluster
+    {{- range $k, $v := .Membership.Labels }}
+    fleet.gke.io/label-{{ $k }}: {{ json $v }}
+    {{- end }}
+  annotations:
+    fleet.gke.io/managed-by-fleet-plugin: "true"
+type: Opaque
+stringData:
+  name: {{.Name}}
+  server: {{.ConnectGatewayURL}}
+  project: {{ json .ProjectNum }}
+`
+	tmpl, err := ParseSecretTemplate(custom)
+	if err != nil {
+		t.Fatalf("ParseSecretTemplate() failed: %v", err)
+	}
+	secret, err := renderSecret(tmpl, SecretTemplateParams{
+		Name:       "m.global.123456",
+		ProjectNum: testProject,
+		Membership: &fleet.Membership{Labels: map[string]string{"env": "prod"}},
+	})
+	if err != nil {
+		t.Fatalf("renderSecret() failed: %v", err)
+	}
+	if secret.Labels["fleet.gke.io/label-env"] != "prod" || string(secret.Data["project"]) != testProject {
+		t.Errorf("renderSecret() = labels %v, data %v", secret.Labels, secret.Data)
+	}
+
+	// Templates may reference the nested fields of the membership.
+	nested := strings.Replace(custom, "  project: {{ json .ProjectNum }}\n",
+		"  cluster: {{ json .Membership.Endpoint.GkeCluster.ResourceLink }}\n  issuer: {{ json .Membership.Authority.Issuer }}\n", 1)
+	if _, err := ParseSecretTemplate(nested); err != nil {
+		t.Errorf("ParseSecretTemplate() of nested membership fields failed: %v", err)
+	}
+
+	for name, invalid := range map[string]string{
+		"malformed":          "{{ .Name",
+		"not_a_secret":       "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{.Name}}\n",
+		"other_namespace":    strings.Replace(custom, "namespace: argocd", "namespace: default", 1),
+		"missing_annotation": strings.Replace(custom, "fleet.gke.io/managed-by-fleet-plugin", "other", 1),
+		"fixed_name":         strings.Replace(custom, "name: {{.Name}}", "name: fixed", 1),
+	} {
+		if _, err := ParseSecretTemplate(invalid); err == nil {
+			t.Errorf("ParseSecretTemplate() of %s template succeeded, want error", name)
+		}
+	}
+}
+
+// newTestSecretReconciler creates a secretReconciler with the client, pruning secrets on their first absence.
+func newTestSecretReconciler(ctx context.Context, t *testing.T, kube kubernetes.Interface) *secretReconciler {
+	t.Helper()
+	cache, err := newSecretCache(ctx, kube)
+	if err != nil {
+		t.Fatalf("newSecretCache() failed: %v", err)
+	}
+	return &secretReconciler{secretCache: cache, guard: pruneGuard{kind: "cluster secrets", metrics: secretPruneMetrics}}
+}
+
+func TestReconcileClusterSecrets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kube := fake.NewClientset()
+	secrets := newTestSecretReconciler(ctx, t, kube)
+	hub := fakehub.NewServer(testFleet(), 0)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	backend, err := NewBackend(ctx, srv.URL+"/", srv.URL+"/")
+	if err != nil {
+		t.Fatalf("NewBackend() failed: %v", err)
+	}
+	c := &FleetSync{
+		backend:          backend,
+		secrets:          secrets,
+		secretTemplate:   template.Must(ParseSecretTemplate(clusterSecretTemplate)),
+		apiTimeout:       defaultAPITimeout,
+		membershipStates: []string{readyState},
+		ProjectNum:       testProject,
+	}
+
+	// waitForSecrets waits for the informer cache to hold the wanted secrets.
+	waitForSecrets := func(want []string) {
+		t.Helper()
+		var got []string
+		err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+			list, err := kube.CoreV1().Secrets(argoCDNamespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return false, err
+			}
+			got = nil
+			for _, s := range list.Items {
+				got = append(got, s.Name)
+			}
+			sort.Strings(got)
+			cached, _ := c.secrets.lister.List(labels.Everything())
+			return slices.Equal(got, want) && len(cached) == len(want), nil
+		})
+		if err != nil {
+			t.Fatalf("secrets = %v, want %v", got, want)
+		}
+	}
+
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	waitForSecrets([]string{"eu-dev.europe-west1.123456", "eu-prod.europe-west1.123456", "us-prod.us-central1.123456"})
+	secret, err := kube.CoreV1().Secrets(argoCDNamespace).Get(ctx, "us-prod.us-central1.123456", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	if got := string(secret.Data["server"]); got != "https://us-central1-connectgateway.googleapis.com/v1/projects/123456/locations/us-central1/gkeMemberships/us-prod" {
+		t.Errorf("secret server = %q", got)
+	}
+
+	wantLabels := map[string]string{
+		"argocd.argoproj.io/secret-type": "cluster",
+		"env":                            "prod",
+		"fleet.gke.io/location":          "us-central1",
+		"fleet.gke.io/scope-frontend":    "true",
+	}
+	if !maps.Equal(secret.Labels, wantLabels) {
+		t.Errorf("secret labels = %v, want %v", secret.Labels, wantLabels)
+	}
+
+	// Unchanged secrets are not applied again.
+	kube.ClearActions()
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if actions := kube.Actions(); len(actions) != 0 {
+		t.Errorf("Refresh() without changes issued %d API calls, want 0", len(actions))
+	}
+
+	// Secrets of unreachable locations are kept, even without a last-known-good snapshot, eg. after a restart.
+	c.regions = nil
+	f := testFleet()
+	f.Unreachable = []string{"europe-west1"}
+	hub.SetFleet(f)
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	waitForSecrets([]string{"eu-dev.europe-west1.123456", "eu-prod.europe-west1.123456", "us-prod.us-central1.123456"})
+
+	// Secrets of removed memberships are pruned, and the labels of removed bindings are removed.
+	f = testFleet()
+	f.Memberships = f.Memberships[:1]
+	f.Bindings = nil
+	hub.SetFleet(f)
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	waitForSecrets([]string{"us-prod.us-central1.123456"})
+	secret, err = kube.CoreV1().Secrets(argoCDNamespace).Get(ctx, "us-prod.us-central1.123456", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	if _, ok := secret.Labels["fleet.gke.io/scope-frontend"]; ok {
+		t.Errorf("secret labels = %v, want no scope label", secret.Labels)
+	}
+}
+
+func TestSecretRenderErrorKeepsSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kube := fake.NewClientset()
+	secrets := newTestSecretReconciler(ctx, t, kube)
+	srv := httptest.NewServer(fakehub.NewServer(testFleet(), 0))
+	defer srv.Close()
+	backend, err := NewBackend(ctx, srv.URL+"/", srv.URL+"/")
+	if err != nil {
+		t.Fatalf("NewBackend() failed: %v", err)
+	}
+	c := &FleetSync{
+		backend:          backend,
+		secrets:          secrets,
+		secretTemplate:   template.Must(ParseSecretTemplate(clusterSecretTemplate)),
+		apiTimeout:       defaultAPITimeout,
+		membershipStates: []string{readyState},
+		ProjectNum:       testProject,
+	}
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		cached, _ := c.secrets.lister.List(labels.Everything())
+		return len(cached) == 3, nil
+	})
+	if err != nil {
+		t.Fatal("the cluster secrets were not cached")
+	}
+
+	// The template fails for us-prod, whose GKE cluster is not on-prem.
+	failing := `{{ if eq .MembershipID "us-prod" }}{{ .Membership.Endpoint.OnPremCluster.ResourceLink }}{{ end }}` + clusterSecretTemplate
+	c.secretTemplate = template.Must(template.New("secret").Parse(failing))
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	list, err := kube.CoreV1().Secrets(argoCDNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	if len(list.Items) != 3 {
+		t.Errorf("secrets = %d, want the 3 secrets, including the one which failed to render", len(list.Items))
+	}
+}
+
+func TestSecretChanged(t *testing.T) {
+	desired, err := renderSecret(template.Must(ParseSecretTemplate(clusterSecretTemplate)), SecretTemplateParams{
+		Name:      "m.global.123456",
+		ServerURL: connectGatewayURL(testProject, "global", "m"),
+	})
+	if err != nil {
+		t.Fatalf("renderSecret() failed: %v", err)
+	}
+	desired.Labels["env"] = "prod"
+	setDesiredHash(desired)
+
+	testCases := []struct {
+		name   string
+		actual func(*corev1.Secret)
+		want   bool
+	}{
+		{name: "unchanged", actual: func(*corev1.Secret) {}},
+		{name: "label_added_by_others", actual: func(s *corev1.Secret) { s.Labels["owner"] = "someone" }},
+		{name: "annotation_added_by_others", actual: func(s *corev1.Secret) { s.Annotations["note"] = "x" }},
+		{name: "label_changed", actual: func(s *corev1.Secret) { s.Labels["env"] = "dev" }, want: true},
+		{name: "data_changed", actual: func(s *corev1.Secret) { s.Data["server"] = []byte("https://other") }, want: true},
+		{name: "data_added", actual: func(s *corev1.Secret) { s.Data["extra"] = []byte("x") }, want: true},
+		{name: "type_changed", actual: func(s *corev1.Secret) { s.Type = corev1.SecretTypeBasicAuth }, want: true},
+		{
+			// A label removed from the desired secret changes its hash.
+			name: "label_removed_from_desired",
+			actual: func(s *corev1.Secret) {
+				s.Labels["removed"] = "true"
+				delete(s.Annotations, desiredHashAnnotation)
+				setDesiredHash(s)
+			},
+			want: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := desired.DeepCopy()
+			tc.actual(actual)
+			if got := secretChanged(actual, desired); got != tc.want {
+				t.Errorf("secretChanged() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewFleetSyncFailureStopsInformers(t *testing.T) {
+	kube := fake.NewClientset()
+	var (
+		mu       sync.Mutex
+		watchers []*watch.RaceFreeFakeWatcher
+	)
+	kube.PrependWatchReactor("secrets", func(k8stesting.Action) (bool, watch.Interface, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		w := watch.NewRaceFreeFake()
+		watchers = append(watchers, w)
+		return true, w, nil
+	})
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := NewFleetSync(ctx, testProject, Options{Endpoint: srv.URL + "/", ContainerEndpoint: srv.URL + "/", KubeClient: kube}); err == nil {
+		t.Fatal("NewFleetSync() succeeded without the Fleet API, want error")
+	}
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, w := range watchers {
+			if !w.IsStopped() {
+				return false, nil
+			}
+		}
+		return len(watchers) > 0, nil
+	})
+	if err != nil {
+		t.Error("the cluster secret watches outlived the failed NewFleetSync()")
+	}
+}
+
+func TestScopeNamespacedSecrets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kube := fake.NewClientset()
+	secrets := newTestSecretReconciler(ctx, t, kube)
+	hub := fakehub.NewServer(testFleet(), 0)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	backend, err := NewBackend(ctx, srv.URL+"/", srv.URL+"/")
+	if err != nil {
+		t.Fatalf("NewBackend() failed: %v", err)
+	}
+	c := &FleetSync{
+		backend:                backend,
+		secrets:                secrets,
+		scopeNamespacedSecrets: true,
+		secretTemplate:         template.Must(ParseSecretTemplate(clusterSecretTemplate)),
+		apiTimeout:             defaultAPITimeout,
+		membershipStates:       []string{readyState},
+		ProjectNum:             testProject,
+	}
+
+	// wantNamespaces waits for the secret of us-prod to be restricted to the namespaces.
+	wantNamespaces := func(want string) {
+		t.Helper()
+		var got *corev1.Secret
+		err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+			got, _ = kube.CoreV1().Secrets(argoCDNamespace).Get(ctx, "us-prod.us-central1.123456", metav1.GetOptions{})
+			return got != nil && string(got.Data["namespaces"]) == want, nil
+		})
+		if err != nil {
+			t.Fatalf("secret namespaces = %q, want %q", got.Data["namespaces"], want)
+		}
+		if got := string(got.Data["clusterResources"]); got != "false" {
+			t.Errorf("secret clusterResources = %q, want \"false\"", got)
+		}
+	}
+
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	wantNamespaces("api,web")
+	// eu-prod is bound to no scope, so it has no secret rather than a cluster-wide one.
+	if _, err := kube.CoreV1().Secrets(argoCDNamespace).Get(ctx, "eu-prod.europe-west1.123456", metav1.GetOptions{}); err == nil {
+		t.Error("eu-prod without fleet namespaces has a cluster secret, want none")
+	}
+
+	// The namespaces follow the namespaces of the scopes.
+	f := testFleet()
+	f.Namespaces = append(f.Namespaces, &fleet.Namespace{Name: "projects/123456/locations/global/scopes/frontend/namespaces/db"})
+	hub.SetFleet(f)
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	wantNamespaces("api,db,web")
+}
+
+// newFakeDynamicClient returns a fake dynamic client of AppProjects, creating or replacing objects on server-side
+// apply, which its object tracker does not support.
+func newFakeDynamicClient(objs ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		appProjectResource: "AppProjectList",
+	}, objs...)
+	client.PrependReactor("patch", "appprojects", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patch.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		tracker := client.Tracker()
+		if _, err := tracker.Get(appProjectResource, patch.GetNamespace(), patch.GetName()); err != nil {
+			return true, obj, tracker.Create(appProjectResource, obj, patch.GetNamespace())
+		}
+		return true, obj, tracker.Update(appProjectResource, obj, patch.GetNamespace())
+	})
+	return client
+}
+
+func TestNewFleetSyncAppProjects(t *testing.T) {
+	srv := httptest.NewServer(fakehub.NewServer(testFleet(), 0))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newFakeDynamicClient()
+	if _, err := NewFleetSync(ctx, testProject, Options{
+		RefreshInterval:   time.Hour,
+		Endpoint:          srv.URL + "/",
+		ContainerEndpoint: srv.URL + "/",
+		DisableSecrets:    true,
+		DynamicClient:     client,
+		AppProjects:       &AppProjectOptions{},
+	}); err != nil {
+		t.Fatalf("NewFleetSync() failed: %v", err)
+	}
+	// The initial refresh applies the AppProjects of the scopes.
+	if _, err := client.Resource(appProjectResource).Namespace(argoCDNamespace).Get(ctx, "frontend.123456", metav1.GetOptions{}); err != nil {
+		t.Errorf("AppProject of scope frontend: %v, want it applied", err)
+	}
+}
+
+func TestReconcileAppProjects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	existing := func(name string, managed bool) runtime.Object {
+		p := &unstructured.Unstructured{}
+		p.SetAPIVersion("argoproj.io/v1alpha1")
+		p.SetKind("AppProject")
+		p.SetName(name)
+		p.SetNamespace(argoCDNamespace)
+		if managed {
+			p.SetAnnotations(map[string]string{managedByAnnotation: "true"})
+		}
+		return p
+	}
+	client := newFakeDynamicClient(existing("removed.123456", true), existing("default", false), existing("frontend.789012", true))
+	cache, err := newAppProjectCache(ctx, client)
+	if err != nil {
+		t.Fatalf("newAppProjectCache() failed: %v", err)
+	}
+	appProjects := &appProjectReconciler{
+		appProjectCache: cache,
+		opts: &AppProjectOptions{
+			SourceRepos:        map[string][]string{"frontend": {"https://github.com/my-org/frontend"}},
+			DefaultSourceRepos: []string{"https://github.com/my-org/*"},
+		},
+		guard: pruneGuard{kind: "AppProjects", metrics: appProjectPruneMetrics},
+	}
+	hub := fakehub.NewServer(testFleet(), 0)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	backend, err := NewBackend(ctx, srv.URL+"/", srv.URL+"/")
+	if err != nil {
+		t.Fatalf("NewBackend() failed: %v", err)
+	}
+	c := &FleetSync{
+		backend:          backend,
+		appProjects:      appProjects,
+		secretTemplate:   template.Must(ParseSecretTemplate(clusterSecretTemplate)),
+		apiTimeout:       defaultAPITimeout,
+		membershipStates: []string{readyState},
+		ProjectNum:       testProject,
+	}
+
+	// waitForAppProjects waits for the informer cache to hold the wanted AppProjects.
+	waitForAppProjects := func(want []string) {
+		t.Helper()
+		var got []string
+		err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+			cached, err := appProjects.lister.List(labels.Everything())
+			if err != nil {
+				return false, err
+			}
+			got = nil
+			for _, obj := range cached {
+				got = append(got, obj.(*unstructured.Unstructured).GetName())
+			}
+			sort.Strings(got)
+			return slices.Equal(got, want), nil
+		})
+		if err != nil {
+			t.Fatalf("AppProjects = %v, want %v", got, want)
+		}
+	}
+
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	// The AppProject of the removed scope is pruned, while those of other fleets and unmanaged ones are kept.
+	waitForAppProjects([]string{"default", "empty.123456", "frontend.123456", "frontend.789012"})
+	p, err := client.Resource(appProjectResource).Namespace(argoCDNamespace).Get(ctx, "frontend.123456", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	destinations, _, _ := unstructured.NestedSlice(p.Object, "spec", "destinations")
+	var got []string
+	for _, d := range destinations {
+		d := d.(map[string]any)
+		got = append(got, fmt.Sprintf("%s %s", d["server"], d["namespace"]))
+	}
+	want := []string{
+		"https://europe-west1-connectgateway.googleapis.com/v1/projects/123456/locations/europe-west1/gkeMemberships/eu-dev api",
+		"https://europe-west1-connectgateway.googleapis.com/v1/projects/123456/locations/europe-west1/gkeMemberships/eu-dev web",
+		"https://us-central1-connectgateway.googleapis.com/v1/projects/123456/locations/us-central1/gkeMemberships/us-prod api",
+		"https://us-central1-connectgateway.googleapis.com/v1/projects/123456/locations/us-central1/gkeMemberships/us-prod web",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("frontend destinations = %v, want %v", got, want)
+	}
+	if repos, _, _ := unstructured.NestedStringSlice(p.Object, "spec", "sourceRepos"); !slices.Equal(repos, []string{"https://github.com/my-org/frontend"}) {
+		t.Errorf("frontend sourceRepos = %v", repos)
+	}
+	p, err = client.Resource(appProjectResource).Namespace(argoCDNamespace).Get(ctx, "empty.123456", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	if repos, _, _ := unstructured.NestedStringSlice(p.Object, "spec", "sourceRepos"); !slices.Equal(repos, []string{"https://github.com/my-org/*"}) {
+		t.Errorf("empty sourceRepos = %v, want the default ones", repos)
+	}
+
+	// Unchanged AppProjects are not applied again.
+	client.ClearActions()
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	for _, a := range client.Actions() {
+		if a.GetVerb() != "list" && a.GetVerb() != "watch" {
+			t.Errorf("Refresh() without changes issued %s %s", a.GetVerb(), a.GetResource().Resource)
+		}
+	}
+
+	// AppProjects edited by others are restored.
+	if _, err := client.Resource(appProjectResource).Namespace(argoCDNamespace).Apply(ctx, "frontend.123456", appProject(testProject, "frontend", nil, nil, []string{"*"}), metav1.ApplyOptions{FieldManager: "someone"}); err != nil {
+		t.Fatalf("Apply() failed: %v", err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		if err := c.Refresh(ctx); err != nil {
+			return false, err
+		}
+		p, err := client.Resource(appProjectResource).Namespace(argoCDNamespace).Get(ctx, "frontend.123456", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		repos, _, _ := unstructured.NestedStringSlice(p.Object, "spec", "sourceRepos")
+		return slices.Equal(repos, []string{"https://github.com/my-org/frontend"}), nil
+	})
+	if err != nil {
+		t.Errorf("edited AppProject was not restored: %v", err)
+	}
+
+	// The AppProjects of deleted scopes are pruned.
+	f := testFleet()
+	f.Scopes = f.Scopes[:1]
+	hub.SetFleet(f)
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	waitForAppProjects([]string{"default", "frontend.123456", "frontend.789012"})
+}
+
+func TestPruneSafety(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var objs []runtime.Object
+	for _, name := range []string{"a.us-central1.123456", "b.us-central1.123456", "c.us-central1.123456", "d.us-central1.123456"} {
+		objs = append(objs, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   argoCDNamespace,
+			Labels:      map[string]string{argoCDSecretTypeLabel: "cluster"},
+			Annotations: map[string]string{managedByAnnotation: "true"},
+		}})
+	}
+	kube := fake.NewClientset(objs...)
+	r := newTestSecretReconciler(ctx, t, kube)
+	r.guard.afterRefreshes = 2
+	r.guard.maxFraction = 0.5
+	keep := func(string) bool { return false }
+	desired := func(names ...string) map[string]*corev1.Secret {
+		ret := make(map[string]*corev1.Secret)
+		for _, n := range names {
+			ret[n+".us-central1.123456"] = nil
+		}
+		return ret
+	}
+
+	// A secret absent from a single refresh, eg. during a glitch, is not pruned.
+	if pruned, err := r.prune(ctx, testProject, desired("a", "b", "c"), keep); err != nil || pruned != 0 {
+		t.Errorf("prune() = %d, %v, want 0 pruned after one absent refresh", pruned, err)
+	}
+	if pruned, err := r.prune(ctx, testProject, desired("a", "b", "c", "d"), keep); err != nil || pruned != 0 {
+		t.Errorf("prune() = %d, %v, want 0 pruned when desired again", pruned, err)
+	}
+	if pruned, err := r.prune(ctx, testProject, desired("a", "b", "c"), keep); err != nil || pruned != 0 {
+		t.Errorf("prune() = %d, %v, want the tombstone reset", pruned, err)
+	}
+	if pruned, err := r.prune(ctx, testProject, desired("a", "b", "c"), keep); err != nil || pruned != 1 {
+		t.Errorf("prune() = %d, %v, want 1 pruned after two absent refreshes", pruned, err)
+	}
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		cached, err := r.lister.List(labels.Everything())
+		return len(cached) == 3, err
+	})
+	if err != nil {
+		t.Fatalf("pruned secret still cached: %v", err)
+	}
+
+	// Pruning 3 of the 3 remaining secrets trips the circuit breaker.
+	for range 3 {
+		if pruned, err := r.prune(ctx, testProject, desired(), keep); err != nil || pruned != 0 {
+			t.Errorf("prune() = %d, %v, want the circuit breaker to refuse pruning", pruned, err)
+		}
+	}
+	r.guard.maxFraction = 1
+	if pruned, err := r.prune(ctx, testProject, desired(), keep); err != nil || pruned != 3 {
+		t.Errorf("prune() = %d, %v, want 3 pruned with the circuit breaker disabled", pruned, err)
+	}
+}
+
+func TestAddFleetLabels(t *testing.T) {
+	longScope := strings.Repeat("s", 58)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:   "m.us-central1.123456",
+		Labels: map[string]string{"env": "template"},
+	}}
+	addFleetLabels(secret, SecretTemplateParams{
+		Location:   "us-central1",
+		Membership: &fleet.Membership{Labels: map[string]string{"env": "prod", "tier": "web"}},
+		Scopes:     []string{"frontend", strings.Repeat("s", 57), longScope},
+	})
+	want := map[string]string{
+		"env":                         "template",
+		"tier":                        "web",
+		"fleet.gke.io/location":       "us-central1",
+		"fleet.gke.io/scope-frontend": "true",
+		"fleet.gke.io/scope-" + strings.Repeat("s", 57): "true",
+	}
+	if !maps.Equal(secret.Labels, want) {
+		t.Errorf("labels = %v, want %v without the scope label longer than 63 characters", secret.Labels, want)
+	}
+}
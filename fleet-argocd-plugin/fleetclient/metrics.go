@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics of the fleet client, registered with the default registry.
+var (
+	fleetAPILatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fleet_plugin_fleet_api_request_duration_seconds",
+		Help:    "Latency of Fleet API list calls, including all pages.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	fleetAPIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_fleet_api_errors_total",
+		Help: "Number of failed Fleet API list calls.",
+	}, []string{"method"})
+	membershipsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_memberships",
+		Help: "Number of fleet memberships in the last successful refresh.",
+	}, []string{"project"})
+	excludedMembershipsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_excluded_memberships",
+		Help: "Number of fleet memberships excluded because of their state in the last successful refresh.",
+	}, []string{"project"})
+	scopesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_scopes",
+		Help: "Number of fleet scopes in the last successful refresh.",
+	}, []string{"project"})
+	secretsApplied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_secrets_applied_total",
+		Help: "Number of Argo CD cluster secrets applied.",
+	}, []string{"project"})
+	secretsPruned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_secrets_pruned_total",
+		Help: "Number of Argo CD cluster secrets pruned.",
+	}, []string{"project"})
+	secretRenderErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_secret_render_errors_total",
+		Help: "Number of Argo CD cluster secrets which failed to render, keeping the existing ones.",
+	}, []string{"project"})
+	featureListErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_feature_list_errors_total",
+		Help: "Number of refreshes which failed to list the fleet features, keeping the last-known feature states.",
+	}, []string{"project"})
+	endpointFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_endpoint_fallbacks_total",
+		Help: "Number of server URLs which failed to resolve, falling back to the last-known or Connect Gateway ones.",
+	}, []string{"project"})
+	pendingPrunes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_pending_prunes",
+		Help: "Number of Argo CD cluster secrets of absent memberships waiting to be pruned.",
+	}, []string{"project"})
+	pruneCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_prune_circuit_open",
+		Help: "Whether the last refresh refused to prune more than the maximum fraction of the cluster secrets.",
+	}, []string{"project"})
+	refusedPrunes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_refused_prunes_total",
+		Help: "Number of refreshes which refused to prune more than the maximum fraction of the cluster secrets.",
+	}, []string{"project"})
+	changeNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_change_notifications_total",
+		Help: "Number of change notifications of fleet resources received, by asset type.",
+	}, []string{"asset_type"})
+	appProjectsApplied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_appprojects_applied_total",
+		Help: "Number of Argo CD AppProjects applied.",
+	}, []string{"project"})
+	appProjectsPruned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_appprojects_pruned_total",
+		Help: "Number of Argo CD AppProjects pruned.",
+	}, []string{"project"})
+	pendingAppProjectPrunes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_pending_appproject_prunes",
+		Help: "Number of Argo CD AppProjects of deleted scopes waiting to be pruned.",
+	}, []string{"project"})
+	appProjectPruneCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_appproject_prune_circuit_open",
+		Help: "Whether the last refresh refused to prune more than the maximum fraction of the AppProjects.",
+	}, []string{"project"})
+	refusedAppProjectPrunes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_refused_appproject_prunes_total",
+		Help: "Number of refreshes which refused to prune more than the maximum fraction of the AppProjects.",
+	}, []string{"project"})
+	refreshErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_refresh_errors_total",
+		Help: "Number of failed fleet refreshes.",
+	}, []string{"project"})
+	regionStaleness = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_region_stale_seconds",
+		Help: "Time since an unreachable location was last reachable, or first reported unreachable, while its last-known-good memberships are served.",
+	}, []string{"project", "location"})
+	lastRefreshTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fleet_plugin_last_successful_refresh_timestamp_seconds",
+		Help: "Unix time of the last successful fleet refresh.",
+	}, []string{"project"})
+)
+
+// observeFleetAPI records the latency and the outcome of a Fleet API call started at start.
+func observeFleetAPI(method string, start time.Time, err error) {
+	fleetAPILatency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		fleetAPIErrors.WithLabelValues(method).Inc()
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pruneGuard applies the pruning safety rules, see Options, to the objects managed by the plugin for a fleet. Zero
+// values prune immediately and without limit.
+type pruneGuard struct {
+	// kind of the guarded objects in logs, eg. "cluster secrets".
+	kind           string
+	afterRefreshes int
+	gracePeriod    time.Duration
+	maxFraction    float64
+	metrics        pruneMetrics
+	// Tombstones of the managed objects absent from the desired ones, by name, only accessed by refreshes.
+	tombstones map[string]*tombstone
+}
+
+// pruneMetrics are the metrics of a pruneGuard, by project.
+type pruneMetrics struct {
+	pending     *prometheus.GaugeVec
+	circuitOpen *prometheus.GaugeVec
+	refused     *prometheus.CounterVec
+}
+
+// tombstone tracks a managed object which is not desired anymore until it is pruned.
+type tombstone struct {
+	// Time of the first refresh the object was absent from.
+	since time.Time
+	// Number of consecutive refreshes the object was absent from.
+	refreshes int
+}
+
+// newPruneGuard returns the pruneGuard of the options, with their defaults.
+func newPruneGuard(kind string, opts Options, metrics pruneMetrics) pruneGuard {
+	g := pruneGuard{
+		kind:           kind,
+		afterRefreshes: opts.PruneAfterRefreshes,
+		gracePeriod:    opts.PruneGracePeriod,
+		maxFraction:    opts.MaxPruneFraction,
+		metrics:        metrics,
+	}
+	if g.afterRefreshes == 0 {
+		g.afterRefreshes = defaultPruneAfterRefreshes
+	}
+	if g.maxFraction == 0 {
+		g.maxFraction = defaultMaxPruneFraction
+	}
+	return g
+}
+
+// due records the absent objects, among the managed ones, and returns those absent for long enough to be pruned.
+// Nothing is due when more than the maximum fraction of the managed objects would be.
+func (g *pruneGuard) due(projectNum string, managed int, absent []string, now time.Time) []string {
+	var due []string
+	tombstones := make(map[string]*tombstone)
+	for _, name := range absent {
+		ts := g.tombstones[name]
+		if ts == nil {
+			ts = &tombstone{since: now}
+		}
+		ts.refreshes++
+		tombstones[name] = ts
+		if ts.refreshes >= g.afterRefreshes && now.Sub(ts.since) >= g.gracePeriod {
+			due = append(due, name)
+		}
+	}
+	// Objects desired again, or deleted by others, are forgotten.
+	g.tombstones = tombstones
+	g.metrics.pending.WithLabelValues(projectNum).Set(float64(len(tombstones)))
+
+	if g.maxFraction > 0 && len(due) > 1 && float64(len(due)) > g.maxFraction*float64(managed) {
+		g.metrics.circuitOpen.WithLabelValues(projectNum).Set(1)
+		g.metrics.refused.WithLabelValues(projectNum).Inc()
+		slog.Error("ALERT: refusing to prune more than the maximum fraction of the "+g.kind, "project", projectNum, "prunes", len(due), "managed", managed, "maxPruneFraction", g.maxFraction)
+		return nil
+	}
+	g.metrics.circuitOpen.WithLabelValues(projectNum).Set(0)
+	return due
+}
+
+// pruned forgets the tombstone of a pruned object.
+func (g *pruneGuard) pruned(name string) {
+	delete(g.tombstones, name)
+}
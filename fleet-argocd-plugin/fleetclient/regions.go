@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	fleet "google.golang.org/api/gkehub/v1"
+)
+
+// regionSnapshot is the last-known-good memberships and membership bindings of a location.
+type regionSnapshot struct {
+	memberships []*fleet.Membership
+	bindings    []*fleet.MembershipBinding
+	// Time the location was last reachable.
+	reachable time.Time
+}
+
+// locationOf returns the location of a membership or membership binding resource name, eg.
+// projects/{project}/locations/{location}/memberships/{membership}.
+func locationOf(name string) string {
+	parts := strings.Split(name, "/")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
+
+// mergeRegions replaces the memberships and bindings of the unreachable locations with their last-known-good
+// snapshot, and records the snapshots of the reachable ones. Locations unreachable since before their first
+// snapshot have no memberships, but their cluster secrets are kept.
+func (c *FleetSync) mergeRegions(mems []*fleet.Membership, mbs []*fleet.MembershipBinding, unreachable []string, now time.Time) ([]*fleet.Membership, []*fleet.MembershipBinding) {
+	regions := make(map[string]*regionSnapshot)
+	snapshot := func(loc string) *regionSnapshot {
+		if regions[loc] == nil {
+			regions[loc] = &regionSnapshot{reachable: now}
+		}
+		return regions[loc]
+	}
+	for _, mem := range mems {
+		s := snapshot(locationOf(mem.Name))
+		s.memberships = append(s.memberships, mem)
+	}
+	for _, mb := range mbs {
+		s := snapshot(locationOf(mb.Name))
+		s.bindings = append(s.bindings, mb)
+	}
+
+	// Resources listed in an unreachable location, if any, are superseded by its snapshot.
+	for _, loc := range unreachable {
+		delete(regions, loc)
+	}
+	mems = filterByLocation(mems, regions, func(m *fleet.Membership) string { return m.Name })
+	mbs = filterByLocation(mbs, regions, func(mb *fleet.MembershipBinding) string { return mb.Name })
+
+	unreachableSince := make(map[string]time.Time)
+	for _, loc := range unreachable {
+		since, ok := c.unreachableSince[loc]
+		if !ok {
+			since = now
+		}
+		unreachableSince[loc] = since
+		if prev, ok := c.regions[loc]; ok {
+			regions[loc] = prev
+			mems = append(mems, prev.memberships...)
+			mbs = append(mbs, prev.bindings...)
+			since = prev.reachable
+		}
+		regionStaleness.WithLabelValues(c.ProjectNum, loc).Set(now.Sub(since).Seconds())
+	}
+	if len(unreachable) > 0 {
+		sort.Strings(unreachable)
+		slog.Warn("Serving the last-known-good memberships of unreachable locations", "project", c.ProjectNum, "locations", unreachable)
+	}
+	for loc := range c.unreachableSince {
+		if _, ok := unreachableSince[loc]; !ok {
+			regionStaleness.DeleteLabelValues(c.ProjectNum, loc)
+		}
+	}
+
+	c.regions = regions
+	c.unreachableSince = unreachableSince
+	return mems, mbs
+}
+
+func filterByLocation[T any](resources []T, regions map[string]*regionSnapshot, name func(T) string) []T {
+	var ret []T
+	for _, res := range resources {
+		if _, ok := regions[locationOf(name(res))]; ok {
+			ret = append(ret, res)
+		}
+	}
+	return ret
+}
+
+// unreachableLocation reports whether the location was unreachable in the last refresh.
+func (c *FleetSync) unreachableLocation(loc string) bool {
+	_, ok := c.unreachableSince[loc]
+	return ok
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Registry serves an allow-list of fleet host projects, lazily creating one FleetSync per project.
+type Registry struct {
+	// ctx is the long-lived context handed to every FleetSync, so that their reconciliation
+	// outlives the request which triggered their creation.
+	ctx     context.Context
+	opts    Options
+	allowed map[string]bool
+
+	mu      sync.Mutex
+	syncs   map[string]*FleetSync
+	pending map[string]*pendingSync
+}
+
+// pendingSync is the creation of the FleetSync of a project, serialized per project so that a slow initial refresh
+// does not block the other projects. A failed creation is cached until its retry time.
+type pendingSync struct {
+	mu       sync.Mutex
+	err      error
+	failures int
+	retryAt  time.Time
+}
+
+// informerCaches lazily creates the informer caches of the Argo CD cluster secrets and AppProjects, once for every
+// FleetSync sharing them, so that serving several fleets does not list and watch the same objects once per fleet.
+// The informers run until ctx is done.
+type informerCaches struct {
+	ctx context.Context
+
+	mu          sync.Mutex
+	secrets     *secretCache
+	appProjects *appProjectCache
+}
+
+// secretInformer returns the cache of the cluster secrets, creating it with the client on first use.
+func (i *informerCaches) secretInformer(client kubernetes.Interface) (*secretCache, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.secrets == nil {
+		secrets, err := newSecretCache(i.ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		i.secrets = secrets
+	}
+	return i.secrets, nil
+}
+
+// appProjectInformer returns the cache of the AppProjects, creating it with the client on first use.
+func (i *informerCaches) appProjectInformer(client dynamic.Interface) (*appProjectCache, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.appProjects == nil {
+		appProjects, err := newAppProjectCache(i.ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		i.appProjects = appProjects
+	}
+	return i.appProjects, nil
+}
+
+// NewRegistry creates a Registry serving the given GCP project numbers of fleet host projects. Its FleetSyncs share
+// the informer caches of the Argo CD cluster secrets and AppProjects.
+func NewRegistry(ctx context.Context, projectNums []string, opts Options) *Registry {
+	allowed := make(map[string]bool)
+	for _, p := range projectNums {
+		allowed[p] = true
+	}
+	opts.caches = &informerCaches{ctx: ctx}
+	return &Registry{
+		ctx:     ctx,
+		opts:    opts,
+		allowed: allowed,
+		syncs:   make(map[string]*FleetSync),
+		pending: make(map[string]*pendingSync),
+	}
+}
+
+// Allowed reports whether the project number is in the allow-list of the Registry.
+func (r *Registry) Allowed(projectNum string) bool {
+	return r.allowed[projectNum]
+}
+
+// Get returns the FleetSync of a fleet host project, creating it on first use. After a failed creation, the error is
+// returned without creating the FleetSync again until the retry time, backed off exponentially like refreshes.
+func (r *Registry) Get(projectNum string) (*FleetSync, error) {
+	if !r.Allowed(projectNum) {
+		return nil, fmt.Errorf("%w: %s", ErrProjectNotAllowed, projectNum)
+	}
+
+	r.mu.Lock()
+	c, ok := r.syncs[projectNum]
+	p := r.pending[projectNum]
+	if !ok && p == nil {
+		p = &pendingSync{}
+		r.pending[projectNum] = p
+	}
+	r.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	// The initial refresh calls the Fleet API, so it runs without holding the lock of the Registry.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r.mu.Lock()
+	c, ok = r.syncs[projectNum]
+	r.mu.Unlock()
+	if ok {
+		// Created while waiting.
+		return c, nil
+	}
+	if p.err != nil && time.Now().Before(p.retryAt) {
+		return nil, p.err
+	}
+	c, err := NewFleetSync(r.ctx, projectNum, r.opts)
+	if err != nil {
+		p.failures++
+		p.retryAt = time.Now().Add(r.retryDelay(p.failures))
+		p.err = fmt.Errorf("%w: failed to create fleet client for project %s, retrying after %s: %w", ErrNotSynced, projectNum, p.retryAt.Format(time.RFC3339), err)
+		return nil, p.err
+	}
+	r.mu.Lock()
+	r.syncs[projectNum] = c
+	delete(r.pending, projectNum)
+	r.mu.Unlock()
+	return c, nil
+}
+
+// retryDelay returns the delay before creating a FleetSync again after consecutive failures.
+func (r *Registry) retryDelay(failures int) time.Duration {
+	interval := r.opts.RefreshInterval
+	if interval == 0 {
+		interval = defaultRefreshInterval
+	}
+	maxBackoff := r.opts.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = max(defaultMaxBackoff, interval)
+	}
+	return backoff(interval, maxBackoff, failures)
+}
+
+// Stale returns the projects whose last successful refresh is older than threshold.
+// Projects which have not been requested yet are not considered.
+func (r *Registry) Stale(threshold time.Duration) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ret []string
+	for p, c := range r.syncs {
+		if time.Since(c.LastRefresh()) > threshold {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// FleetSyncs returns the FleetSyncs created so far, by project number.
+func (r *Registry) FleetSyncs() map[string]*FleetSync {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make(map[string]*FleetSync, len(r.syncs))
+	for p, c := range r.syncs {
+		ret[p] = c
+	}
+	return ret
+}
+
+// Wait waits until the reconciliation of every FleetSync has stopped, once the context of the Registry is done, or
+// until ctx is done.
+func (r *Registry) Wait(ctx context.Context) error {
+	for _, c := range r.FleetSyncs() {
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
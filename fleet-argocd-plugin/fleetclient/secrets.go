@@ -0,0 +1,368 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// Namespace of the Argo CD cluster secrets.
+	argoCDNamespace = "argocd"
+	// Label of the Argo CD cluster secrets, https://argo-cd.readthedocs.io/en/stable/operator-manual/declarative-setup/#clusters
+	argoCDSecretTypeLabel = "argocd.argoproj.io/secret-type"
+	// Annotation of the cluster secrets managed by the plugin.
+	managedByAnnotation = "fleet.gke.io/managed-by-fleet-plugin"
+	// Annotation of the hash of the desired secret, to detect removed labels, annotations and data.
+	desiredHashAnnotation = "fleet.gke.io/desired-hash"
+	// Label of the membership location on the cluster secrets.
+	locationLabel = "fleet.gke.io/location"
+	// Label prefix of the scopes bound to the membership on the cluster secrets, eg. fleet.gke.io/scope-team-a: "true".
+	scopeLabelPrefix = "fleet.gke.io/scope-"
+	// Field manager of the server-side apply patches of the plugin.
+	fieldManager = "fleet-argocd-plugin"
+)
+
+// secretReconciler applies the cluster secrets of a fleet, diffing them against an informer cache of the existing
+// Argo CD cluster secrets.
+type secretReconciler struct {
+	*secretCache
+	guard pruneGuard
+}
+
+// secretCache is an informer cache of the Argo CD cluster secrets, shared by the secretReconcilers of every fleet.
+type secretCache struct {
+	client kubernetes.Interface
+	lister corev1listers.SecretNamespaceLister
+}
+
+// secretPruneMetrics are the pruning metrics of the cluster secrets.
+var secretPruneMetrics = pruneMetrics{pending: pendingPrunes, circuitOpen: pruneCircuitOpen, refused: refusedPrunes}
+
+// newSecretCache creates a secretCache with the client, or an in-cluster client if nil, and waits for it to sync. The
+// informer runs until ctx is done.
+func newSecretCache(ctx context.Context, clientset kubernetes.Interface) (*secretCache, error) {
+	if clientset == nil {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get in cluster config: %w", err)
+		}
+		if clientset, err = kubernetes.NewForConfig(config); err != nil {
+			return nil, fmt.Errorf("failed to create Kubernetes clientset: %w", err)
+		}
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(argoCDNamespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = argoCDSecretTypeLabel + "=cluster"
+		}))
+	lister := factory.Core().V1().Secrets().Lister()
+	factory.Start(ctx.Done())
+	for _, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return nil, fmt.Errorf("failed to sync cluster secrets cache")
+		}
+	}
+	return &secretCache{client: clientset, lister: lister.Secrets(argoCDNamespace)}, nil
+}
+
+func (c *FleetSync) reconcileClusterSecrets(ctx context.Context) error {
+	if c.secrets == nil {
+		return nil
+	}
+	// Construct a map of desired cluster secrets, from name to Secret.
+	clusterSecrets := make(map[string]*corev1.Secret)
+	for membership, scopes := range c.MembershipTenancyMapCache {
+		parts := strings.Split(membership, "/")
+		scopes = append([]string{}, scopes...)
+		sort.Strings(scopes)
+		params := SecretTemplateParams{
+			Name:              fmt.Sprintf(clusterSecretNameTemplate, parts[5], parts[3], c.ProjectNum),
+			ServerURL:         c.ServerURLCache[membership],
+			ConnectGatewayURL: c.ServerURLCache[membership],
+			ProjectNum:        c.ProjectNum,
+			Location:          parts[3],
+			MembershipID:      parts[5],
+			Membership:        c.MembershipCache[membership],
+			Scopes:            scopes,
+			Namespaces:        c.scopeNamespaces(scopes),
+		}
+		if c.scopeNamespacedSecrets && len(params.Namespaces) == 0 {
+			// An empty namespaces field would grant access to the whole cluster.
+			continue
+		}
+		secret, err := renderSecret(c.secretTemplate, params)
+		if err != nil {
+			// Keep the existing secret, rather than removing the cluster from Argo CD over one template value.
+			secretRenderErrors.WithLabelValues(c.ProjectNum).Inc()
+			slog.Error("Error rendering Secret, keeping the existing one", "membership", membership, "error", err)
+			if existing, err := c.secrets.lister.Get(params.Name); err == nil {
+				clusterSecrets[params.Name] = existing
+			}
+			continue
+		}
+		addFleetLabels(secret, params)
+		if c.scopeNamespacedSecrets {
+			restrictToNamespaces(secret, params.Namespaces)
+		}
+		setDesiredHash(secret)
+		clusterSecrets[params.Name] = secret
+	}
+
+	// Apply the changed Secrets to the cluster.
+	applied, err := c.secrets.apply(ctx, clusterSecrets)
+	if err != nil {
+		return fmt.Errorf("failed to apply secret: %w", err)
+	}
+	secretsApplied.WithLabelValues(c.ProjectNum).Add(float64(applied))
+
+	// Prune cluster secrets that are no longer existing in the Fleet.
+	pruned, err := c.secrets.prune(ctx, c.ProjectNum, clusterSecrets, c.unreachableLocation)
+	if err != nil {
+		return err
+	}
+	if applied > 0 || pruned > 0 {
+		slog.Info("Reconciled cluster secrets", "project", c.ProjectNum, "applied", applied, "pruned", pruned)
+	}
+	return nil
+}
+
+// apply server-side applies the desired secrets which differ from the cached ones, and returns how many were applied.
+func (r *secretReconciler) apply(ctx context.Context, clusterSecrets map[string]*corev1.Secret) (int, error) {
+	names := make([]string, 0, len(clusterSecrets))
+	for name := range clusterSecrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	applied := 0
+	for _, name := range names {
+		desired := clusterSecrets[name]
+		actual, err := r.lister.Get(name)
+		if err != nil && !errors.IsNotFound(err) {
+			return applied, fmt.Errorf("error getting secret %s from cache: %v", name, err)
+		}
+		if actual != nil && !secretChanged(actual, desired) {
+			continue
+		}
+		patch := corev1ac.Secret(desired.Name, desired.Namespace).
+			WithLabels(desired.Labels).
+			WithAnnotations(desired.Annotations).
+			WithType(desired.Type).
+			WithData(desired.Data)
+		applyCtx, span := tracer.Start(ctx, "secrets.Apply", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("k8s.secret.name", name)))
+		_, err = r.client.CoreV1().Secrets(desired.Namespace).Apply(applyCtx, patch, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+			Force:        true,
+		})
+		EndSpan(span, err)
+		if err != nil {
+			return applied, fmt.Errorf("error applying secret %s: %v", name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// prune deletes the cached secrets managed by the plugin for the fleet project which have not been desired for long
+// enough, except those of the locations to keep, and returns how many were deleted. Nothing is deleted when more
+// than the maximum fraction of the managed secrets would be.
+func (r *secretReconciler) prune(ctx context.Context, projectNum string, clusterSecrets map[string]*corev1.Secret, keep func(location string) bool) (int, error) {
+	existingSecrets, err := r.lister.List(labels.Everything())
+	if err != nil {
+		return 0, fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	managed := 0
+	var absent []string
+	secrets := make(map[string]*corev1.Secret)
+	for _, secret := range existingSecrets {
+		// Skip secrets that are not managed by the fleet plugin.
+		if secret.Annotations[managedByAnnotation] != "true" {
+			continue
+		}
+		// Skip secrets of other fleet host projects served by the same plugin.
+		if !strings.HasSuffix(secret.Name, "."+projectNum) {
+			continue
+		}
+		managed++
+		if _, exists := clusterSecrets[secret.Name]; exists {
+			continue
+		}
+		// Never delete the secrets of unreachable locations, named {membership}.{location}.{project}.
+		if parts := strings.Split(secret.Name, "."); len(parts) == 3 && keep(parts[1]) {
+			continue
+		}
+		// Secret no longer corresponds to a membership, delete it once it has been absent for long enough.
+		absent = append(absent, secret.Name)
+		secrets[secret.Name] = secret
+	}
+
+	pruned := 0
+	for _, name := range r.guard.due(projectNum, managed, absent, time.Now()) {
+		secret := secrets[name]
+		deleteCtx, span := tracer.Start(ctx, "secrets.Delete", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("k8s.secret.name", secret.Name)))
+		err := r.client.CoreV1().Secrets(secret.Namespace).Delete(deleteCtx, secret.Name, metav1.DeleteOptions{})
+		EndSpan(span, err)
+		r.guard.pruned(name)
+		if errors.IsNotFound(err) {
+			// Already deleted, but still in the cache.
+			continue
+		}
+		if err != nil {
+			return pruned, fmt.Errorf("failed to delete secret: %w", err)
+		}
+		secretsPruned.WithLabelValues(projectNum).Inc()
+		pruned++
+	}
+	return pruned, nil
+}
+
+// scopeNamespaces returns the sorted, distinct fleet namespaces of the scopes.
+func (c *FleetSync) scopeNamespaces(scopes []string) []string {
+	var ret []string
+	for _, scope := range scopes {
+		for _, ns := range c.ScopeNamespacesCache[scope] {
+			nsID := ns.Name[strings.LastIndex(ns.Name, "/")+1:]
+			if !slices.Contains(ret, nsID) {
+				ret = append(ret, nsID)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// restrictToNamespaces restricts the Argo CD cluster secret to the namespaces, without cluster-scoped resources.
+func restrictToNamespaces(secret *corev1.Secret, namespaces []string) {
+	secret.Data["namespaces"] = []byte(strings.Join(namespaces, ","))
+	secret.Data["clusterResources"] = []byte("false")
+}
+
+// addFleetLabels labels the secret with the membership labels, location and bound scopes, so that Argo CD cluster
+// generators can select fleet clusters. Labels set by the template take precedence. Invalid labels, eg. the scope
+// labels of scope IDs longer than 57 characters, are skipped, as they would fail the apply of the secret.
+func addFleetLabels(secret *corev1.Secret, params SecretTemplateParams) {
+	labels := map[string]string{
+		locationLabel: params.Location,
+	}
+	if params.Membership != nil {
+		for k, v := range params.Membership.Labels {
+			labels[k] = v
+		}
+	}
+	for _, scope := range params.Scopes {
+		labels[scopeLabelPrefix+scope] = "true"
+	}
+	if secret.Labels == nil {
+		secret.Labels = make(map[string]string)
+	}
+	for k, v := range labels {
+		if _, ok := secret.Labels[k]; ok {
+			continue
+		}
+		if errs := append(validation.IsQualifiedName(k), validation.IsValidLabelValue(v)...); len(errs) > 0 {
+			slog.Warn("Skipping invalid label of cluster secret", "secret", secret.Name, "label", k, "errors", errs)
+			continue
+		}
+		secret.Labels[k] = v
+	}
+}
+
+// setDesiredHash annotates the secret with a hash of its labels, annotations, type and data.
+func setDesiredHash(secret *corev1.Secret) {
+	delete(secret.Annotations, desiredHashAnnotation)
+	// Maps are marshaled with sorted keys.
+	data, _ := json.Marshal([]any{secret.Labels, secret.Annotations, secret.Type, secret.Data})
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	secret.Annotations[desiredHashAnnotation] = fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// secretChanged reports whether the actual secret differs from the fields of the desired secret set by the plugin.
+// Labels and annotations added by others are ignored, while those removed from the desired secret change its hash.
+func secretChanged(actual, desired *corev1.Secret) bool {
+	for k, v := range desired.Labels {
+		if actual.Labels[k] != v {
+			return true
+		}
+	}
+	for k, v := range desired.Annotations {
+		if actual.Annotations[k] != v {
+			return true
+		}
+	}
+	if actual.Type != desired.Type {
+		return true
+	}
+	return !maps.EqualFunc(actual.Data, desired.Data, bytes.Equal)
+}
+
+// secretDecoder decodes Secret manifests.
+var secretDecoder = func() runtime.Decoder {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		panic(fmt.Sprintf("error adding to scheme: %v", err))
+	}
+	return serializer.NewCodecFactory(scheme).UniversalDeserializer()
+}()
+
+// secretFromManifest decodes a Secret manifest, merging its stringData into data as the API server does.
+func secretFromManifest(manifest string) (*corev1.Secret, error) {
+	obj, _, err := secretDecoder.Decode([]byte(manifest), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifest %q: %v", manifest, err)
+	}
+	// Type assertion to ensure it's a corev1.Secret
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil, fmt.Errorf("decoded object is not of type Secret")
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+	secret.StringData = nil
+	return secret, nil
+}
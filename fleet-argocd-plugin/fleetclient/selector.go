@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Selector filters the memberships included in the plugin results. An empty Selector matches every membership.
+type Selector struct {
+	// LabelSelector matches the membership labels.
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	// Locations only includes memberships in one of the locations, eg. "europe-west1" or "global".
+	Locations []string `json:"locations,omitempty"`
+	// ExcludeLocations excludes memberships in any of the locations.
+	ExcludeLocations []string `json:"excludeLocations,omitempty"`
+	// NamePatterns only includes memberships whose ID matches one of the regular expressions.
+	NamePatterns []string `json:"namePatterns,omitempty"`
+	// Features only includes memberships with each fleet feature enabled, in the given state code if not empty,
+	// eg. {"configmanagement": "OK"}.
+	Features map[string]string `json:"features,omitempty"`
+}
+
+// compiledSelector is a Selector with its label selector and regular expressions parsed.
+type compiledSelector struct {
+	Selector
+	labels   labels.Selector
+	patterns []*regexp.Regexp
+}
+
+// Validate returns an error if the label selector or a name pattern is malformed.
+func (s Selector) Validate() error {
+	_, err := s.compile()
+	return err
+}
+
+func (s Selector) compile() (*compiledSelector, error) {
+	cs := &compiledSelector{
+		Selector: s,
+		labels:   labels.Everything(),
+	}
+	if s.LabelSelector != nil {
+		sel, err := metav1.LabelSelectorAsSelector(s.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid labelSelector: %v", ErrInvalidRequest, err)
+		}
+		cs.labels = sel
+	}
+	for _, p := range s.NamePatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid namePatterns entry %q: %v", ErrInvalidRequest, p, err)
+		}
+		cs.patterns = append(cs.patterns, re)
+	}
+	return cs, nil
+}
+
+// matches reports whether the Result of a membership is selected.
+func (cs *compiledSelector) matches(r Result) bool {
+	if len(cs.Locations) > 0 && !slices.Contains(cs.Locations, r.Location) {
+		return false
+	}
+	if slices.Contains(cs.ExcludeLocations, r.Location) {
+		return false
+	}
+	if !cs.labels.Matches(labels.Set(r.Metadata.Labels)) {
+		return false
+	}
+	for f, code := range cs.Features {
+		state, ok := r.Features[f]
+		if !ok || code != "" && state.State != code {
+			return false
+		}
+	}
+	if len(cs.patterns) == 0 {
+		return true
+	}
+	for _, re := range cs.patterns {
+		if re.MatchString(r.NameShort) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	fleet "google.golang.org/api/gkehub/v1"
+)
+
+// Membership state included by default, see https://cloud.google.com/kubernetes-engine/fleet-management/docs/reference/rest/v1/projects.locations.memberships#code
+const readyState = "READY"
+
+// ExcludedMembership is a membership which is not a deploy target because of its state.
+type ExcludedMembership struct {
+	// Name is the full resource name of the membership.
+	Name string `json:"name"`
+	// State is the membership state code, eg. "CREATING" or "DELETING".
+	State string `json:"state"`
+	// LastIncluded is the last time the membership was in an included state, if ever.
+	LastIncluded *time.Time `json:"lastIncluded,omitempty"`
+}
+
+func membershipState(mem *fleet.Membership) string {
+	if mem.State == nil || mem.State.Code == "" {
+		return "CODE_UNSPECIFIED"
+	}
+	return mem.State.Code
+}
+
+// filterMemberships returns the memberships in one of the included states, or which left them less than the grace
+// period ago, and the excluded ones.
+func (c *FleetSync) filterMemberships(mems []*fleet.Membership, now time.Time) ([]*fleet.Membership, []ExcludedMembership) {
+	lastIncluded := make(map[string]time.Time)
+	var included []*fleet.Membership
+	var excluded []ExcludedMembership
+	for _, mem := range mems {
+		state := membershipState(mem)
+		if slices.Contains(c.membershipStates, state) {
+			lastIncluded[mem.Name] = now
+			included = append(included, mem)
+			continue
+		}
+		last, ok := c.lastIncluded[mem.Name]
+		if ok {
+			lastIncluded[mem.Name] = last
+			if now.Sub(last) < c.stateGracePeriod {
+				included = append(included, mem)
+				continue
+			}
+		}
+		ex := ExcludedMembership{Name: mem.Name, State: state}
+		if ok {
+			ex.LastIncluded = &last
+		}
+		excluded = append(excluded, ex)
+	}
+	sort.Slice(excluded, func(i, j int) bool { return excluded[i].Name < excluded[j].Name })
+	// Memberships which are not listed anymore are forgotten.
+	c.lastIncluded = lastIncluded
+	return included, excluded
+}
+
+// ExcludedMemberships returns the memberships excluded from the plugin results and cluster secrets because of
+// their state, as of the last successful refresh.
+func (c *FleetSync) ExcludedMemberships() []ExcludedMembership {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.excluded
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"text/template"
+
+	fleet "google.golang.org/api/gkehub/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SecretTemplateParams are the parameters of the cluster secret template.
+type SecretTemplateParams struct {
+	// Name of the secret, {{.MembershipID}}.{{.Location}}.{{.ProjectNum}}.
+	Name string
+	// ServerURL is the server URL of the cluster, as selected by the endpoint strategy of the membership.
+	ServerURL string
+	// ConnectGatewayURL is the same as ServerURL.
+	//
+	// Deprecated: use ServerURL, which is not necessarily a Connect Gateway URL.
+	ConnectGatewayURL string
+	// ProjectNum is the project number of the fleet host project.
+	ProjectNum   string
+	Location     string
+	MembershipID string
+	// Membership is the full fleet membership, eg. {{.Membership.Labels}} or {{.Membership.Endpoint.GkeCluster}}.
+	Membership *fleet.Membership
+	// Scopes are the sorted IDs of the scopes the membership is bound to.
+	Scopes []string
+	// Namespaces are the sorted fleet namespaces of the scopes the membership is bound to.
+	Namespaces []string
+}
+
+// secretTemplateFuncs are the functions available to cluster secret templates.
+var secretTemplateFuncs = template.FuncMap{
+	// json quotes a value as JSON, which is also a valid YAML scalar, eg. {{ json .Membership.Description }}.
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// ParseSecretTemplate parses and validates a cluster secret template. Rendered for a sample membership, the template
+// must produce a Secret named {{.Name}} in the argocd namespace, labeled as an Argo CD cluster secret and annotated
+// as managed by the plugin, so that the plugin can find the secrets it manages.
+func ParseSecretTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("secret").Funcs(secretTemplateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse secret template: %w", err)
+	}
+	sample := SecretTemplateParams{
+		Name:              "membership.us-central1.123456",
+		ServerURL:         connectGatewayURL("123456", "us-central1", "membership"),
+		ConnectGatewayURL: connectGatewayURL("123456", "us-central1", "membership"),
+		ProjectNum:        "123456",
+		Location:          "us-central1",
+		MembershipID:      "membership",
+		Membership: &fleet.Membership{
+			Name:   "projects/123456/locations/us-central1/memberships/membership",
+			Labels: map[string]string{"env": "prod"},
+			Endpoint: &fleet.MembershipEndpoint{
+				GkeCluster:         &fleet.GkeCluster{ResourceLink: gkeResourceLinkPrefix + "projects/my-project/locations/us-central1/clusters/cluster"},
+				KubernetesMetadata: &fleet.KubernetesMetadata{KubernetesApiServerVersion: "v1.30.5-gke.1014001"},
+			},
+			State: &fleet.MembershipState{Code: readyState},
+		},
+		Scopes:     []string{"scope"},
+		Namespaces: []string{"namespace"},
+	}
+	// Templates may reference any field of the membership, eg. {{ .Membership.Authority.Issuer }}.
+	allocateNil(reflect.ValueOf(sample.Membership).Elem())
+	secret, err := renderSecret(tmpl, sample)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret template: %w", err)
+	}
+	switch {
+	case secret.Name != sample.Name:
+		return nil, fmt.Errorf("invalid secret template: name is %q, want {{.Name}}", secret.Name)
+	case secret.Namespace != argoCDNamespace:
+		return nil, fmt.Errorf("invalid secret template: namespace is %q, want %s", secret.Namespace, argoCDNamespace)
+	case secret.Labels[argoCDSecretTypeLabel] != "cluster":
+		return nil, fmt.Errorf("invalid secret template: missing label %s: cluster", argoCDSecretTypeLabel)
+	case secret.Annotations[managedByAnnotation] != "true":
+		return nil, fmt.Errorf("invalid secret template: missing annotation %s: \"true\"", managedByAnnotation)
+	}
+	return tmpl, nil
+}
+
+// allocateNil sets the nil pointers to structs of the struct v, recursively, to zero values.
+func allocateNil(v reflect.Value) {
+	for i := range v.NumField() {
+		f := v.Field(i)
+		if f.Kind() != reflect.Pointer || f.Type().Elem().Kind() != reflect.Struct || !f.CanSet() {
+			continue
+		}
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		allocateNil(f.Elem())
+	}
+}
+
+// renderSecret executes the cluster secret template and decodes the resulting Secret.
+func renderSecret(tmpl *template.Template, params SecretTemplateParams) (*corev1.Secret, error) {
+	var secretManifest bytes.Buffer
+	if err := tmpl.Execute(&secretManifest, params); err != nil {
+		return nil, fmt.Errorf("error creating Secret manifest: %w", err)
+	}
+	secret, err := secretFromManifest(secretManifest.String())
+	if err != nil {
+		return nil, fmt.Errorf("error converting manifest %q to a k8s secret: %v", secretManifest.String(), err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name of the spans of the plugin.
+const TracerName = "fleet-management-tools/argocd-sync"
+
+// tracer uses the global TracerProvider, which does not record spans unless the plugin exports them.
+var tracer = otel.Tracer(TracerName)
+
+// EndSpan records the error, if any, on the span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// listPages calls a paginated Fleet API list method, with a span per page, until the last page. list fetches the page
+// of the token, and returns the token of the next page, or "" after the last one.
+func listPages(ctx context.Context, method string, list func(ctx context.Context, pageToken string) (string, error)) error {
+	start := time.Now()
+	token := ""
+	var err error
+	for page := 0; ; page++ {
+		pageCtx, span := tracer.Start(ctx, "fleetapi."+method, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("fleetapi.method", method), attribute.Int("fleetapi.page", page)))
+		token, err = list(pageCtx, token)
+		EndSpan(span, err)
+		if err != nil || token == "" {
+			break
+		}
+	}
+	observeFleetAPI(method, start, err)
+	return err
+}
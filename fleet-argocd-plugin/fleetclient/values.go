@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// placeholder matches the {{param}} placeholders of templated values, eg. "replicas-{{location}}" or
+// "{{ metadata.labels.env }}".
+var placeholder = regexp.MustCompile(`{{\s*([A-Za-z0-9_.\-/]+)\s*}}`)
+
+// ApplyValues sets the Values of each result to the free-form values, with the {{param}} placeholders of string
+// values, including nested ones, replaced by the parameters of the result. Unknown parameters are left as is.
+func ApplyValues(results []Result, values map[string]any) []Result {
+	if len(values) == 0 {
+		return results
+	}
+	for i := range results {
+		params := flatParams(results[i])
+		resolved := make(map[string]any, len(values))
+		for k, v := range values {
+			resolved[k] = resolveValue(v, params)
+		}
+		results[i].Values = resolved
+	}
+	return results
+}
+
+func resolveValue(v any, params map[string]string) any {
+	switch v := v.(type) {
+	case string:
+		return placeholder.ReplaceAllStringFunc(v, func(m string) string {
+			if p, ok := params[placeholder.FindStringSubmatch(m)[1]]; ok {
+				return p
+			}
+			return m
+		})
+	case map[string]any:
+		ret := make(map[string]any, len(v))
+		for k, e := range v {
+			ret[k] = resolveValue(e, params)
+		}
+		return ret
+	case []any:
+		ret := make([]any, len(v))
+		for i, e := range v {
+			ret[i] = resolveValue(e, params)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+// flatParams returns the parameters of a result flattened with dots, the way Argo CD flattens them for
+// non-Go templates, eg. "location" or "metadata.labels.env".
+func flatParams(r Result) map[string]string {
+	r.Values = nil
+	params := make(map[string]string)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return params
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return params
+	}
+	flatten("", obj, params)
+	return params
+}
+
+func flatten(prefix string, v any, params map[string]string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			flatten(joinKey(prefix, k), e, params)
+		}
+	case []any:
+		for i, e := range v {
+			flatten(joinKey(prefix, fmt.Sprint(i)), e, params)
+		}
+		strs := make([]string, 0, len(v))
+		for _, e := range v {
+			strs = append(strs, fmt.Sprint(e))
+		}
+		params[prefix] = strings.Join(strs, ",")
+	case nil:
+		params[prefix] = ""
+	default:
+		params[prefix] = fmt.Sprint(v)
+	}
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
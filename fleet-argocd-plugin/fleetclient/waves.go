@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fleetclient
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+
+	"sigs.k8s.io/yaml"
+)
+
+// WavePolicy assigns each membership a rollout wave, from 0, with exactly one of Label, Locations or Buckets.
+type WavePolicy struct {
+	// Label is a membership label whose integer value is the wave, eg. "rollout-wave".
+	Label string `json:"label,omitempty"`
+	// Default is the wave of memberships without a valid Label.
+	Default int `json:"default,omitempty"`
+	// Locations are the locations of each wave in order, eg. [["us-central1"], ["europe-west1", "europe-west4"]].
+	// Memberships in other locations are in the wave after the last one.
+	Locations [][]string `json:"locations,omitempty"`
+	// Buckets spreads the memberships over this many waves by a stable hash of their name.
+	Buckets int `json:"buckets,omitempty"`
+}
+
+// LoadWavePolicy reads and validates a YAML or JSON wave policy file.
+func LoadWavePolicy(file string) (*WavePolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p WavePolicy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse wave policy %s: %w", file, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid wave policy %s: %w", file, err)
+	}
+	return &p, nil
+}
+
+// Validate returns an error unless exactly one way of assigning waves is set. A nil policy is valid.
+func (p *WavePolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	set := 0
+	for _, ok := range []bool{p.Label != "", len(p.Locations) > 0, p.Buckets != 0} {
+		if ok {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		return fmt.Errorf("%w: wave policy must set exactly one of label, locations or buckets", ErrInvalidRequest)
+	case p.Buckets < 0:
+		return fmt.Errorf("%w: wave policy buckets must be positive", ErrInvalidRequest)
+	case p.Default < 0:
+		return fmt.Errorf("%w: wave policy default must not be negative", ErrInvalidRequest)
+	}
+	return nil
+}
+
+// wave returns the wave of the Result of a membership.
+func (p *WavePolicy) wave(r Result) int {
+	switch {
+	case p == nil:
+		return 0
+	case p.Label != "":
+		if w, err := strconv.Atoi(r.Metadata.Labels[p.Label]); err == nil && w >= 0 {
+			return w
+		}
+		return p.Default
+	case len(p.Locations) > 0:
+		for i, locations := range p.Locations {
+			if slices.Contains(locations, r.Location) {
+				return i
+			}
+		}
+		return len(p.Locations)
+	default:
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(r.Name))
+		return int(h.Sum32() % uint32(p.Buckets))
+	}
+}
+
+// ApplyWaves sets the wave of each result, drops those after maxWave if not nil, and sorts them by wave, name and
+// namespace. A nil policy puts every result in wave 0.
+func ApplyWaves(results []Result, p *WavePolicy, maxWave *int) []Result {
+	ret := []Result{}
+	for _, r := range results {
+		r.Wave = p.wave(r)
+		if maxWave != nil && r.Wave > *maxWave {
+			continue
+		}
+		ret = append(ret, r)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Wave != ret[j].Wave {
+			return ret[i].Wave < ret[j].Wave
+		}
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].Namespace < ret[j].Namespace
+	})
+	return ret
+}
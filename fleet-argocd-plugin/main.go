@@ -15,42 +15,438 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fleet-management-tools/argocd-sync/authz"
 	"fleet-management-tools/argocd-sync/fleetclient"
-	"fmt"      // formatting and printing values to the console.
-	"log"      // logging messages to the console.
+	"fmt" // formatting and printing values to the console.
+	"log/slog"
 	"net/http" // Used for build HTTP servers and clients.
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/yaml"
+)
+
+// Timeouts of the HTTP server.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	// The first request of a fleet waits for its initial refresh.
+	writeTimeout = 2 * time.Minute
+	idleTimeout  = 2 * time.Minute
+)
+
+// Number of refresh intervals without a successful refresh after which the plugin is not ready, unless
+// STALENESS_THRESHOLD is set.
+const defaultStalenessIntervals = 6
+
+// defaultStalenessThreshold is the default age of the last successful refresh after which the plugin is not ready.
+// It outlasts the maximum backoff, so that the plugin is ready again on the first refresh after a Fleet API
+// outage, rather than one refresh interval after a backed off refresh.
+func defaultStalenessThreshold(refreshInterval, maxBackoff time.Duration) time.Duration {
+	return max(defaultStalenessIntervals*refreshInterval, maxBackoff+defaultStalenessIntervals*refreshInterval/2)
+}
+
+// HTTP response headers reporting the freshness of the fleet topology.
+const (
+	lastRefreshHeader = "X-Fleet-Last-Refresh"
+	staleHeader       = "X-Fleet-Stale"
 )
 
-var fleetSync *fleetclient.FleetSync
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_requests_total",
+		Help: "Number of valid and authorized plugin generator requests per ApplicationSet.",
+	}, []string{"applicationset"})
+	deniedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fleet_plugin_denied_requests_total",
+		Help: "Number of plugin generator requests denied by the authorization policy per fleet project.",
+	}, []string{"project"})
+)
+
+var (
+	fleetSyncs *fleetclient.Registry
+	// Maximum age of the last successful refresh for the plugin to be ready.
+	stalenessThreshold time.Duration
+	// Whether to serve the last-known-good topology when the most recent refresh failed.
+	serveStale bool
+	// Bearer token of the plugin shared with the ApplicationSet controller, empty to allow unauthenticated requests.
+	pluginToken string
+	// ApplicationSet-to-scope authorization policy, nil to allow every request.
+	policy *authz.Policy
+	// Default rollout wave policy, nil to put every cluster in wave 0.
+	wavePolicy *fleetclient.WavePolicy
+)
 
 func main() {
-	log.Println("Starting GKE Fleet argocd plugin...")
-	projectNum := os.Getenv("FLEET_PROJECT_NUMBER")
-	if projectNum == "" {
-		log.Fatal("ENV var FLEET_PROJECT_NUMBER not found")
+	slog.SetDefault(newLogger())
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+	slog.Info("Starting GKE Fleet argocd plugin")
+	projectNums := projectNumbers()
+	if len(projectNums) == 0 {
+		fatal("Invalid configuration", errors.New("ENV var FLEET_PROJECT_NUMBERS or FLEET_PROJECT_NUMBER not found"))
 	}
 	portNum := os.Getenv("PORT")
 	if portNum == "" {
-		log.Fatal("ENV var PORT not found")
+		fatal("Invalid configuration", errors.New("ENV var PORT not found"))
 	}
-	// Start fleet client.
-	ctx := context.Background()
-	var err error
-	fleetSync, err = fleetclient.NewFleetSync(ctx, projectNum)
+	shutdownTimeout, err := durationEnv("SHUTDOWN_TIMEOUT", 20*time.Second)
 	if err != nil {
-		fmt.Printf("Error creating fleet client: %v\n", err)
-		log.Fatal(err)
+		fatal("Invalid configuration", err)
+	}
+	opts := loadOptions()
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("Error setting up tracing", err)
+	}
+	// The refreshes of the fleets stop on SIGTERM, while in-flight requests are drained.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	// Fleet clients are started on the first request for each project.
+	fleetSyncs = fleetclient.NewRegistry(ctx, projectNums, opts)
+	slog.Info("Serving fleet projects", "projects", projectNums)
+	if subscription := os.Getenv("EVENTS_SUBSCRIPTION"); subscription != "" {
+		var endpoint string
+		if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+			endpoint = "http://" + host + "/"
+		}
+		subscriber, err := fleetclient.NewSubscriber(ctx, subscription, endpoint, fleetSyncs)
+		if err != nil {
+			fatal("Error subscribing to change notifications", err)
+		}
+		go subscriber.Run(ctx)
+		slog.Info("Refreshing fleets on change notifications", "subscription", subscription, "refreshInterval", opts.RefreshInterval)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/getparams.execute", Reply)
+	mux.HandleFunc("/healthz", Healthz)
+	mux.HandleFunc("/readyz", Readyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/excluded", ExcludedMemberships)
+	mux.HandleFunc("/api/v1/refresh", TriggerRefresh)
+	srv := &http.Server{
+		Addr:              listenAddr(portNum),
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		fatal("Invalid configuration", errors.New("ENV vars TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if certFile != "" {
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			fatal("Error loading TLS certificate", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
 	}
-	http.HandleFunc("/api/v1/getparams.execute", Reply)
+
 	// Spinning up the server.
-	log.Println("Started on port", portNum)
-	fmt.Println("To close connection CTRL+C :-)")
-	err = http.ListenAndServe(portNum, nil)
+	go func() {
+		slog.Info("Started", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Error serving", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(srv, shutdownTimeout, shutdownTracing)
+	slog.Info("Stopped")
+}
+
+// shutdown drains the in-flight requests of the server, waits for the refreshes of the fleets to stop, and flushes
+// the traces, within the timeout.
+func shutdown(srv *http.Server, timeout time.Duration, shutdownTracing func(context.Context) error) {
+	slog.Info("Shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Error draining requests", "error", err)
+	}
+	if err := fleetSyncs.Wait(ctx); err != nil {
+		slog.Error("Error stopping fleet refreshes", "error", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+}
+
+// newLogger returns the structured logger of the plugin, in JSON unless LOG_FORMAT is "text", at the LOG_LEVEL, eg.
+// "debug", or info by default.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if os.Getenv("LOG_FORMAT") == "text" {
+		return slog.New(slog.NewTextHandler(os.Stderr, handlerOpts))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts))
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// listenAddr returns the listen address of PORT, either a port number, eg. "4356", or an address, eg. ":4356".
+func listenAddr(port string) string {
+	if strings.Contains(port, ":") {
+		return port
+	}
+	return ":" + port
+}
+
+// loadOptions reads the configuration of the plugin from ENV vars, setting the global request handling settings and
+// returning the options of the fleet clients. It exits on invalid configuration.
+func loadOptions() fleetclient.Options {
+	defaultRefreshInterval := 10 * time.Second
+	if os.Getenv("EVENTS_SUBSCRIPTION") != "" {
+		// Change notifications trigger the refreshes, polling is only a safety net against lost ones.
+		defaultRefreshInterval = 5 * time.Minute
+	}
+	refreshInterval, err := durationEnv("REFRESH_INTERVAL", defaultRefreshInterval)
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	apiTimeout, err := durationEnv("API_TIMEOUT", 30*time.Second)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Invalid configuration", err)
+	}
+	maxBackoff, err := durationEnv("MAX_BACKOFF", max(5*time.Minute, refreshInterval))
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	stalenessThreshold, err = durationEnv("STALENESS_THRESHOLD", defaultStalenessThreshold(refreshInterval, maxBackoff))
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	if stalenessThreshold <= maxBackoff {
+		slog.Warn("STALENESS_THRESHOLD is not longer than MAX_BACKOFF, the plugin may stay not ready after a Fleet API outage until the next backed off refresh", "stalenessThreshold", stalenessThreshold, "maxBackoff", maxBackoff)
+	}
+	stateGracePeriod, err := durationEnv("STATE_GRACE_PERIOD", 5*time.Minute)
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	pruneGracePeriod, err := durationEnv("PRUNE_GRACE_PERIOD", 0)
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	var pruneAfterRefreshes int
+	if env := os.Getenv("PRUNE_AFTER_REFRESHES"); env != "" {
+		if pruneAfterRefreshes, err = strconv.Atoi(env); err != nil || pruneAfterRefreshes <= 0 {
+			fatal("Invalid configuration", fmt.Errorf("invalid ENV var PRUNE_AFTER_REFRESHES: %q is not a positive integer", env))
+		}
+	}
+	var maxPruneFraction float64
+	if env := os.Getenv("PRUNE_MAX_FRACTION"); env != "" {
+		if maxPruneFraction, err = strconv.ParseFloat(env, 64); err != nil || maxPruneFraction <= 0 || maxPruneFraction > 1 {
+			fatal("Invalid configuration", fmt.Errorf("invalid ENV var PRUNE_MAX_FRACTION: %q is not in (0, 1]", env))
+		}
+	}
+	var secretTemplate string
+	if file := os.Getenv("SECRET_TEMPLATE_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fatal("Invalid configuration", err)
+		}
+		// Validate the template at startup, rather than on the first request of each fleet.
+		if _, err := fleetclient.ParseSecretTemplate(string(data)); err != nil {
+			fatal("Invalid SECRET_TEMPLATE_FILE", fmt.Errorf("%s: %w", file, err))
+		}
+		secretTemplate = string(data)
+	}
+	endpoints := fleetclient.EndpointOptions{
+		Default: os.Getenv("ENDPOINT_STRATEGY"),
+		Label:   os.Getenv("ENDPOINT_STRATEGY_LABEL"),
+	}
+	if file := os.Getenv("ENDPOINT_TEMPLATES_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fatal("Invalid configuration", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &endpoints.Templates); err != nil {
+			fatal("Invalid ENDPOINT_TEMPLATES_FILE", fmt.Errorf("%s: %w", file, err))
+		}
+	}
+	if err := fleetclient.ValidateEndpointOptions(endpoints); err != nil {
+		fatal("Invalid configuration", err)
+	}
+	serveStale = os.Getenv("SERVE_STALE") != "false"
+	if file := os.Getenv("PLUGIN_TOKEN_FILE"); file != "" {
+		if pluginToken, err = authz.LoadToken(file); err != nil {
+			fatal("Invalid configuration", err)
+		}
+	} else if os.Getenv("POLICY_FILE") != "" {
+		slog.Warn("Authorizing ApplicationSets without PLUGIN_TOKEN_FILE, any caller may claim any ApplicationSet name")
+	}
+	if file := os.Getenv("POLICY_FILE"); file != "" {
+		if policy, err = authz.LoadPolicy(file); err != nil {
+			fatal("Invalid configuration", err)
+		}
+		slog.Info("Authorizing ApplicationSets", "rules", len(policy.Rules), "policyFile", file)
+	}
+	var appProjects *fleetclient.AppProjectOptions
+	if file := os.Getenv("APP_PROJECTS_FILE"); file != "" {
+		if appProjects, err = fleetclient.LoadAppProjectOptions(file); err != nil {
+			fatal("Invalid configuration", err)
+		}
+	}
+	if file := os.Getenv("WAVE_POLICY_FILE"); file != "" {
+		if wavePolicy, err = fleetclient.LoadWavePolicy(file); err != nil {
+			fatal("Invalid configuration", err)
+		}
+	}
+	return fleetclient.Options{
+		RefreshInterval:        refreshInterval,
+		APITimeout:             apiTimeout,
+		MaxBackoff:             maxBackoff,
+		Endpoint:               os.Getenv("FLEET_API_ENDPOINT"),
+		ContainerEndpoint:      os.Getenv("GKE_API_ENDPOINT"),
+		DisableSecrets:         os.Getenv("RECONCILE_SECRETS") == "false",
+		PruneAfterRefreshes:    pruneAfterRefreshes,
+		PruneGracePeriod:       pruneGracePeriod,
+		MaxPruneFraction:       maxPruneFraction,
+		MembershipStates:       listEnv("MEMBERSHIP_STATES"),
+		StateGracePeriod:       stateGracePeriod,
+		SecretTemplate:         secretTemplate,
+		Endpoints:              endpoints,
+		ScopeNamespacedSecrets: os.Getenv("SECRET_SCOPE_NAMESPACES") == "true",
+		AppProjects:            appProjects,
+	}
+}
+
+// projectNumbers returns the allow-list of fleet host project numbers served by the plugin,
+// from the comma separated FLEET_PROJECT_NUMBERS, or the single FLEET_PROJECT_NUMBER.
+func projectNumbers() []string {
+	if ret := listEnv("FLEET_PROJECT_NUMBERS"); len(ret) > 0 {
+		return ret
+	}
+	return listEnv("FLEET_PROJECT_NUMBER")
+}
+
+// listEnv returns the non-empty entries of the comma separated ENV var.
+func listEnv(name string) []string {
+	var ret []string
+	for _, p := range strings.Split(os.Getenv(name), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// durationEnv parses the ENV var as a duration, eg. "30s", returning def if it is not set.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	env := os.Getenv(name)
+	if env == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(env)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ENV var %s: %w", name, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid ENV var %s: must be positive", name)
 	}
+	return d, nil
+}
+
+// Healthz is the liveness handler of the plugin.
+func Healthz(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("ok"))
+}
+
+// Readyz is the readiness handler of the plugin, failing when a fleet has not been refreshed successfully
+// within the staleness threshold.
+func Readyz(w http.ResponseWriter, _ *http.Request) {
+	if stale := fleetSyncs.Stale(stalenessThreshold); len(stale) > 0 {
+		http.Error(w, fmt.Sprintf("fleet projects %v not refreshed successfully in the last %v", stale, stalenessThreshold), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+// authenticated reports whether the request carries the plugin token, replying 401 otherwise.
+func authenticated(w http.ResponseWriter, r *http.Request) bool {
+	if err := authz.Authenticate(r.Header.Get("Authorization"), pluginToken); err != nil {
+		slog.Warn("AUDIT: request unauthenticated", "remoteAddr", r.RemoteAddr, "path", r.URL.Path)
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// ExcludedMemberships is the debug handler listing the memberships excluded because of their state, by project.
+func ExcludedMemberships(w http.ResponseWriter, r *http.Request) {
+	if !authenticated(w, r) {
+		return
+	}
+	excluded := make(map[string][]fleetclient.ExcludedMembership)
+	for p, c := range fleetSyncs.FleetSyncs() {
+		excluded[p] = c.ExcludedMemberships()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(excluded)
+}
+
+// TriggerRefresh is the handler requesting an immediate refresh of the fleet of the project query parameter, or of
+// every served fleet if unset, eg. after changing memberships or bindings.
+func TriggerRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Triggers cost Fleet API quota, and count off the refreshes before pruning.
+	if !authenticated(w, r) {
+		return
+	}
+	if projectNum := r.URL.Query().Get("project"); projectNum != "" {
+		c, err := fleetSyncs.Get(projectNum)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		c.TriggerRefresh()
+	} else {
+		for _, c := range fleetSyncs.FleetSyncs() {
+			c.TriggerRefresh()
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
 }
 
 // PluginRequest is the request object sent to the plugin generator service.
@@ -71,6 +467,17 @@ type Input struct {
 type ParametersRequest struct {
 	FleetProjectNumber string `json:"fleetProjectNumber"`
 	ScopeID            string `json:"scopeId"`
+	// PerNamespace returns one parameter set per fleet namespace of the scope on each membership.
+	PerNamespace bool `json:"perNamespace"`
+	// Values are free-form values added to each parameter set, where string values may reference the parameters
+	// of the membership, eg. "replicas-{{location}}".
+	Values map[string]any `json:"values"`
+	// Selector further filters the memberships, eg. by labels, locations and names.
+	fleetclient.Selector
+	// WavePolicy overrides the default rollout wave policy of the plugin.
+	WavePolicy *fleetclient.WavePolicy `json:"wavePolicy,omitempty"`
+	// MaxWave only returns the clusters in waves up to this one, for staged rollouts.
+	MaxWave *int `json:"maxWave,omitempty"`
 }
 
 // PluginResponse is the response object returned by the plugin generator service.
@@ -82,52 +489,176 @@ type PluginResponse struct {
 // Output is the map of outputs returned by the plugin generator.
 type Output struct {
 	Parameters []fleetclient.Result `json:"parameters"`
+	// Stale is true when the parameters are from the last-known-good topology, as the most recent refresh failed.
+	Stale bool `json:"stale,omitempty"`
+	// LastRefresh is the time of the last successful refresh of the fleet topology, in RFC 3339 format.
+	LastRefresh string `json:"lastRefresh"`
+}
+
+// ErrorResponse is the JSON body of an error returned by the plugin generator service.
+type ErrorResponse struct {
+	Error ErrorStatus `json:"error"`
+}
+
+// ErrorStatus describes an error returned by the plugin generator service.
+type ErrorStatus struct {
+	// Code is the HTTP status code.
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// httpStatus maps an error of the fleet client to an HTTP status code.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, fleetclient.ErrInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, authz.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, fleetclient.ErrProjectNotAllowed), errors.Is(err, authz.ErrDenied):
+		return http.StatusForbidden
+	case errors.Is(err, fleetclient.ErrUnknownScope):
+		return http.StatusNotFound
+	case errors.Is(err, fleetclient.ErrNotSynced), errors.Is(err, fleetclient.ErrStale):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError replies with the error as a JSON body, and the HTTP status code of the error.
+func writeError(w http.ResponseWriter, err error) {
+	code := httpStatus(err)
+	if code == http.StatusInternalServerError {
+		slog.Error("Error rendering result", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorStatus{
+			Code:    code,
+			Message: err.Error(),
+		},
+	})
 }
 
 // Reply is the handler for the fleet plugin generator.
 func Reply(w http.ResponseWriter, r *http.Request) {
+	// Continue the trace of the ApplicationSet controller, if any.
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "Reply", trace.WithSpanKind(trace.SpanKindServer))
+	var err error
+	defer func() { fleetclient.EndSpan(span, err) }()
+
+	// Only the ApplicationSet controller may claim an ApplicationSet name.
+	if err = authz.Authenticate(r.Header.Get("Authorization"), pluginToken); err != nil {
+		slog.Warn("AUDIT: request unauthenticated", "remoteAddr", r.RemoteAddr)
+		writeError(w, err)
+		return
+	}
+
 	// Decode incoming plugin request.
 	var request PluginRequest
-	err := json.NewDecoder(r.Body).Decode(&request)
+	err = json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	// Validate parameters.
-	projectNum := request.Input.Parameters.FleetProjectNumber
-	if projectNum == "" {
-		http.Error(w, "Missing required parameter FleetProjectNumber", http.StatusBadRequest)
-		return
-	}
-	if projectNum != fleetSync.ProjectNum {
-		http.Error(w, "Invalid fleetProjectNumber in request, doesn't match FLEET_PROJECT_NUMBER specified in the Fleet plugin", http.StatusBadRequest)
+		err = fmt.Errorf("%w: %v", fleetclient.ErrInvalidRequest, err)
+		writeError(w, err)
 		return
 	}
-	scopeID := request.Input.Parameters.ScopeID
-	res, err := fleetSync.PluginResults(context.Background(), scopeID)
+	span.SetAttributes(
+		attribute.String("argocd.applicationset", request.ApplicationSetName),
+		attribute.String("fleet.project", request.Input.Parameters.FleetProjectNumber),
+		attribute.String("fleet.scope", request.Input.Parameters.ScopeID),
+	)
+	response, err := render(ctx, request)
 	if err != nil {
-		fmt.Printf("Error rendering result: %v\n", err)
-		http.Error(w, "Error rendering result", http.StatusInternalServerError)
+		writeError(w, err)
+		return
 	}
 	// Encode plugin response.
-	response := PluginResponse{
-		Output{
-			Parameters: res,
-		},
-	}
 	jsonData, err := json.Marshal(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(lastRefreshHeader, response.Output.LastRefresh)
+	if response.Output.Stale {
+		w.Header().Set(staleHeader, "true")
+	}
 	_, err = w.Write(jsonData)
 	if err != nil {
-		fmt.Printf("Error writing HTTP reply: %v\n", err)
-		http.Error(w, "Error writing HTTP reply", http.StatusInternalServerError)
+		slog.Error("Error writing HTTP reply", "error", err)
+		return
 	}
 
-	fmt.Printf("%+v\n", response)
-	fmt.Println("-------------------------------------------")
+	slog.Info("Replied to plugin request", "applicationset", request.ApplicationSetName, "project", request.Input.Parameters.FleetProjectNumber, "scope", request.Input.Parameters.ScopeID, "parameters", len(response.Output.Parameters), "stale", response.Output.Stale)
+	slog.Debug("Plugin response", "response", response)
+}
+
+// render computes the response to a plugin request, as served by Reply.
+func render(ctx context.Context, request PluginRequest) (*PluginResponse, error) {
+	// Validate parameters.
+	projectNum := request.Input.Parameters.FleetProjectNumber
+	if projectNum == "" {
+		return nil, fmt.Errorf("%w: missing required parameter fleetProjectNumber", fleetclient.ErrInvalidRequest)
+	}
+	if !fleetSyncs.Allowed(projectNum) {
+		return nil, fmt.Errorf("%w: %s, not in FLEET_PROJECT_NUMBERS specified in the Fleet plugin", fleetclient.ErrProjectNotAllowed, projectNum)
+	}
+	scopeID := request.Input.Parameters.ScopeID
+	perNamespace := request.Input.Parameters.PerNamespace
+	if perNamespace && scopeID == "" {
+		return nil, fmt.Errorf("%w: missing required parameter scopeId with perNamespace", fleetclient.ErrInvalidRequest)
+	}
+	if err := policy.Authorize(request.ApplicationSetName, projectNum, scopeID); err != nil {
+		// Audit log of denied requests.
+		slog.Warn("AUDIT: request denied", "applicationset", request.ApplicationSetName, "project", projectNum, "scope", scopeID, "error", err)
+		// Denied ApplicationSet names are not metric labels, as callers could create arbitrary ones.
+		deniedRequestsTotal.WithLabelValues(projectNum).Inc()
+		return nil, err
+	}
+	selector := request.Input.Parameters.Selector
+	if err := selector.Validate(); err != nil {
+		return nil, err
+	}
+	waves := wavePolicy
+	if request.Input.Parameters.WavePolicy != nil {
+		waves = request.Input.Parameters.WavePolicy
+		if err := waves.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	// Only valid and authorized requests are counted, so that callers cannot create arbitrary ApplicationSet labels.
+	requestsTotal.WithLabelValues(request.ApplicationSetName).Inc()
+	fleetSync, err := fleetSyncs.Get(projectNum)
+	if err != nil {
+		return nil, err
+	}
+
+	// Serve the last-known-good topology if the most recent refresh failed, unless disabled.
+	lastRefresh, refreshErr := fleetSync.RefreshStatus()
+	stale := refreshErr != nil
+	if stale && !serveStale {
+		return nil, fmt.Errorf("%w, last successful refresh at %s: %v", fleetclient.ErrStale, lastRefresh.Format(time.RFC3339), refreshErr)
+	}
+
+	var res []fleetclient.Result
+	if perNamespace {
+		res, err = fleetSync.NamespaceResults(ctx, scopeID, selector)
+	} else {
+		res, err = fleetSync.PluginResults(ctx, scopeID, selector)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res = fleetclient.ApplyWaves(res, waves, request.Input.Parameters.MaxWave)
+	res = fleetclient.ApplyValues(res, request.Input.Parameters.Values)
+	return &PluginResponse{
+		Output{
+			Parameters:  res,
+			Stale:       stale,
+			LastRefresh: lastRefresh.Format(time.RFC3339),
+		},
+	}, nil
 }
@@ -0,0 +1,511 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fleet-management-tools/argocd-sync/authz"
+	"fleet-management-tools/argocd-sync/fakehub"
+	"fleet-management-tools/argocd-sync/fleetclient"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const testProject = "123456"
+
+// setupFleet serves the fleet of testdata/fleet.json with a fake GKE Hub server, and points the plugin at it with
+// the default request handling settings.
+func setupFleet(t *testing.T) *httptest.Server {
+	t.Helper()
+	data, err := os.ReadFile("testdata/fleet.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f fakehub.Fleet
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(fakehub.NewServer(f, 0))
+	t.Cleanup(srv.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	fleetSyncs = fleetclient.NewRegistry(ctx, []string{testProject}, fleetclient.Options{
+		RefreshInterval:   time.Hour,
+		Endpoint:          srv.URL + "/",
+		ContainerEndpoint: srv.URL + "/",
+		DisableSecrets:    true,
+	})
+	stalenessThreshold = time.Hour
+	serveStale = true
+	pluginToken = ""
+	policy = nil
+	wavePolicy = nil
+	return srv
+}
+
+// postRequest serves the plugin request body with Reply.
+func postRequest(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/getparams.execute", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	Reply(w, req)
+	return w
+}
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	Healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Healthz() = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	setupFleet(t)
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	// Fleets which have not been requested yet do not affect readiness.
+	if got := readyz(); got != http.StatusOK {
+		t.Errorf("Readyz() before any request = %d, want %d", got, http.StatusOK)
+	}
+	if _, err := fleetSyncs.Get(testProject); err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	if got := readyz(); got != http.StatusOK {
+		t.Errorf("Readyz() after a refresh = %d, want %d", got, http.StatusOK)
+	}
+	stalenessThreshold = time.Nanosecond
+	if got := readyz(); got != http.StatusServiceUnavailable {
+		t.Errorf("Readyz() past the staleness threshold = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
+
+func TestDefaultStalenessThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		refreshInterval, maxBackoff, want time.Duration
+	}{
+		{refreshInterval: 10 * time.Second, maxBackoff: 5 * time.Minute, want: 5*time.Minute + 30*time.Second},
+		{refreshInterval: 5 * time.Minute, maxBackoff: 5 * time.Minute, want: 30 * time.Minute},
+		{refreshInterval: time.Minute, maxBackoff: time.Hour, want: time.Hour + 3*time.Minute},
+	} {
+		got := defaultStalenessThreshold(tc.refreshInterval, tc.maxBackoff)
+		if got != tc.want {
+			t.Errorf("defaultStalenessThreshold(%v, %v) = %v, want %v", tc.refreshInterval, tc.maxBackoff, got, tc.want)
+		}
+		// The first refresh after the longest backoff keeps the plugin ready.
+		if got <= tc.maxBackoff+tc.refreshInterval {
+			t.Errorf("defaultStalenessThreshold(%v, %v) = %v, not longer than the maximum backoff", tc.refreshInterval, tc.maxBackoff, got)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	setupFleet(t)
+	if w := postRequest(t, `{"applicationSetName": "metrics-test", "input": {"parameters": {"fleetProjectNumber": "123456"}}}`); w.Code != http.StatusOK {
+		t.Fatalf("Reply() = %d: %s", w.Code, w.Body)
+	}
+
+	// Invalid requests do not create ApplicationSet labels.
+	if w := postRequest(t, `{"applicationSetName": "metrics-invalid", "input": {"parameters": {"fleetProjectNumber": "999"}}}`); w.Code != http.StatusForbidden {
+		t.Fatalf("Reply() = %d: %s", w.Code, w.Body)
+	}
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(w.Body.String(), "metrics-invalid") {
+		t.Error("metrics count an invalid request")
+	}
+	for _, want := range []string{
+		`fleet_plugin_requests_total{applicationset="metrics-test"} 1`,
+		`fleet_plugin_memberships{project="123456"} 3`,
+		`fleet_plugin_scopes{project="123456"} 2`,
+		`fleet_plugin_fleet_api_request_duration_seconds_count{method="ListMemberships"}`,
+		`fleet_plugin_last_successful_refresh_timestamp_seconds{project="123456"}`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	setupFleet(t)
+
+	testCases := []struct {
+		name       string
+		body       string
+		wantCode   int
+		wantParams int
+	}{
+		{
+			name:     "malformed_request",
+			body:     `{"input": `,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "missing_project",
+			body:     `{"input": {"parameters": {}}}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "project_not_allowed",
+			body:     `{"input": {"parameters": {"fleetProjectNumber": "999"}}}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "per_namespace_without_scope",
+			body:     `{"input": {"parameters": {"fleetProjectNumber": "123456", "perNamespace": true}}}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid_selector",
+			body:     `{"input": {"parameters": {"fleetProjectNumber": "123456", "namePatterns": ["("]}}}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unknown_scope",
+			body:     `{"input": {"parameters": {"fleetProjectNumber": "123456", "scopeId": "unknown"}}}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "scope_without_clusters",
+			body:     `{"input": {"parameters": {"fleetProjectNumber": "123456", "scopeId": "backend"}}}`,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:       "scope",
+			body:       `{"input": {"parameters": {"fleetProjectNumber": "123456", "scopeId": "frontend"}}}`,
+			wantCode:   http.StatusOK,
+			wantParams: 2,
+		},
+		{
+			name:       "all_clusters",
+			body:       `{"input": {"parameters": {"fleetProjectNumber": "123456"}}}`,
+			wantCode:   http.StatusOK,
+			wantParams: 3,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := postRequest(t, tc.body)
+			if w.Code != tc.wantCode {
+				t.Fatalf("Reply() = %d: %s, want %d", w.Code, w.Body, tc.wantCode)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if tc.wantCode != http.StatusOK {
+				// A single JSON error body, with the status code.
+				var resp ErrorResponse
+				dec := json.NewDecoder(w.Body)
+				if err := dec.Decode(&resp); err != nil {
+					t.Fatalf("error body %q is not JSON: %v", w.Body, err)
+				}
+				if resp.Error.Code != tc.wantCode || resp.Error.Message == "" {
+					t.Errorf("error body = %+v, want code %d and a message", resp, tc.wantCode)
+				}
+				if dec.More() {
+					t.Error("Reply() wrote more than one JSON body")
+				}
+				return
+			}
+			// An empty result is a JSON list, not null.
+			var resp struct {
+				Output struct {
+					Parameters []json.RawMessage `json:"parameters"`
+				} `json:"output"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response %q is not JSON: %v", w.Body, err)
+			}
+			if resp.Output.Parameters == nil || len(resp.Output.Parameters) != tc.wantParams {
+				t.Errorf("Reply() = %s, want %d parameters", w.Body, tc.wantParams)
+			}
+			if w.Header().Get(lastRefreshHeader) == "" || w.Header().Get(staleHeader) != "" {
+				t.Errorf("headers = %v, want a fresh last refresh", w.Header())
+			}
+		})
+	}
+}
+
+func TestReplyStale(t *testing.T) {
+	srv := setupFleet(t)
+	c, err := fleetSyncs.Get(testProject)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	lastRefresh := c.LastRefresh().Format(time.RFC3339)
+	srv.Close()
+	if err := c.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh() succeeded without the Fleet API, want error")
+	}
+	body := `{"input": {"parameters": {"fleetProjectNumber": "123456"}}}`
+
+	// The last-known-good topology is served, flagged as stale.
+	w := postRequest(t, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Reply() = %d: %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if got := w.Header().Get(staleHeader); got != "true" {
+		t.Errorf("%s = %q, want true", staleHeader, got)
+	}
+	if got := w.Header().Get(lastRefreshHeader); got != lastRefresh {
+		t.Errorf("%s = %q, want %q", lastRefreshHeader, got, lastRefresh)
+	}
+	var resp PluginResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response %q is not JSON: %v", w.Body, err)
+	}
+	if !resp.Output.Stale || resp.Output.LastRefresh != lastRefresh || len(resp.Output.Parameters) != 3 {
+		t.Errorf("Reply() = %s, want the 3 stale clusters", w.Body)
+	}
+
+	serveStale = false
+	w = postRequest(t, body)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Reply() without SERVE_STALE = %d: %s, want %d", w.Code, w.Body, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: bad", fleetclient.ErrInvalidRequest), http.StatusBadRequest},
+		{fmt.Errorf("%w: no token", authz.ErrUnauthenticated), http.StatusUnauthorized},
+		{fmt.Errorf("%w: 999", fleetclient.ErrProjectNotAllowed), http.StatusForbidden},
+		{fmt.Errorf("%w: scope", authz.ErrDenied), http.StatusForbidden},
+		{fmt.Errorf("%w: scope", fleetclient.ErrUnknownScope), http.StatusNotFound},
+		{fmt.Errorf("%w: refresh failed", fleetclient.ErrNotSynced), http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: refresh failed", fleetclient.ErrStale), http.StatusServiceUnavailable},
+		{errors.New("unexpected"), http.StatusInternalServerError},
+	} {
+		if got := httpStatus(tc.err); got != tc.want {
+			t.Errorf("httpStatus(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestReplyValues(t *testing.T) {
+	setupFleet(t)
+	w := postRequest(t, `{"input": {"parameters": {"fleetProjectNumber": "123456", "scopeId": "frontend", "locations": ["us-central1"], "values": {"replicas": "replicas-{{location}}"}}}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Reply() = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Output struct {
+			Parameters []map[string]any `json:"parameters"`
+		} `json:"output"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Output.Parameters) != 1 {
+		t.Fatalf("Reply() = %s, %v, want one cluster", w.Body, err)
+	}
+	params := resp.Output.Parameters[0]
+	// Argo CD replaces the values key with the plugin.values of the generator.
+	if _, ok := params["values"]; ok {
+		t.Errorf("parameters = %v, want no values key", params)
+	}
+	if values, _ := params["resolvedValues"].(map[string]any); values["replicas"] != "replicas-us-central1" {
+		t.Errorf("resolvedValues = %v, want replicas: replicas-us-central1", params["resolvedValues"])
+	}
+}
+
+func TestReplyAuthorization(t *testing.T) {
+	setupFleet(t)
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(file, []byte("rules:\n- applicationSets: [\"team-a-*\"]\n  scopes: [frontend]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if policy, err = authz.LoadPolicy(file); err != nil {
+		t.Fatalf("LoadPolicy() failed: %v", err)
+	}
+	pluginToken = "secret"
+
+	testCases := []struct {
+		name     string
+		token    string
+		appSet   string
+		scope    string
+		wantCode int
+	}{
+		{name: "allowed", token: "secret", appSet: "team-a-web", scope: "frontend", wantCode: http.StatusOK},
+		{name: "denied_scope", token: "secret", appSet: "team-a-web", scope: "backend", wantCode: http.StatusForbidden},
+		{name: "denied_all_clusters", token: "secret", appSet: "team-a-web", wantCode: http.StatusForbidden},
+		{name: "missing_token", appSet: "team-a-web", scope: "frontend", wantCode: http.StatusUnauthorized},
+		{name: "invalid_token", token: "guess", appSet: "team-a-web", scope: "frontend", wantCode: http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"applicationSetName": %q, "input": {"parameters": {"fleetProjectNumber": "123456", "scopeId": %q}}}`, tc.appSet, tc.scope)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/getparams.execute", strings.NewReader(body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			Reply(w, req)
+			if w.Code != tc.wantCode {
+				t.Errorf("Reply() = %d: %s, want %d", w.Code, w.Body, tc.wantCode)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `fleet_plugin_denied_requests_total{project="123456"} 2`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("metrics are missing %s", want)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	hub := setupFleet(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fleetSyncs = fleetclient.NewRegistry(ctx, []string{testProject}, fleetclient.Options{
+		RefreshInterval:   time.Hour,
+		Endpoint:          hub.URL + "/",
+		ContainerEndpoint: hub.URL + "/",
+		DisableSecrets:    true,
+	})
+	c, err := fleetSyncs.Get(testProject)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	url := "http://" + ln.Addr().String()
+	replied := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("HTTP %d", resp.StatusCode)
+			}
+		}
+		replied <- err
+	}()
+	<-started
+
+	// As on SIGTERM, the refreshes stop and the in-flight request is drained before shutdown returns.
+	cancel()
+	var flushed atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		shutdown(srv, 10*time.Second, func(context.Context) error {
+			flushed.Store(true)
+			return nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("shutdown() returned with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-replied; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("shutdown() did not return after draining the requests")
+	}
+	select {
+	case <-c.Done():
+	default:
+		t.Error("shutdown() returned before the refreshes stopped")
+	}
+	if !flushed.Load() {
+		t.Error("shutdown() did not flush the traces")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("server accepted a request after shutdown")
+	}
+}
+
+func TestOperationsAuthentication(t *testing.T) {
+	setupFleet(t)
+	pluginToken = "secret"
+
+	testCases := []struct {
+		name     string
+		handler  http.HandlerFunc
+		method   string
+		target   string
+		token    string
+		wantCode int
+	}{
+		{name: "refresh_missing_token", handler: TriggerRefresh, method: http.MethodPost, target: "/api/v1/refresh?project=123456", wantCode: http.StatusUnauthorized},
+		{name: "refresh_invalid_token", handler: TriggerRefresh, method: http.MethodPost, target: "/api/v1/refresh", token: "guess", wantCode: http.StatusUnauthorized},
+		{name: "excluded_missing_token", handler: ExcludedMemberships, method: http.MethodGet, target: "/debug/excluded", wantCode: http.StatusUnauthorized},
+		{name: "excluded", handler: ExcludedMemberships, method: http.MethodGet, target: "/debug/excluded", token: "secret", wantCode: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			tc.handler(w, req)
+			if w.Code != tc.wantCode {
+				t.Errorf("%s %s = %d: %s, want %d", tc.method, tc.target, w.Code, w.Body, tc.wantCode)
+			}
+		})
+	}
+	// Unauthenticated triggers do not start the fleet client of the project.
+	if syncs := fleetSyncs.FleetSyncs(); len(syncs) != 0 {
+		t.Errorf("FleetSyncs() = %v after unauthenticated triggers, want none", syncs)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/refresh?project=123456", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	TriggerRefresh(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("TriggerRefresh() = %d: %s, want %d", w.Code, w.Body, http.StatusAccepted)
+	}
+	if _, ok := fleetSyncs.FleetSyncs()[testProject]; !ok {
+		t.Error("TriggerRefresh() did not start the fleet client of the project")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate and its key to the files, modified at modTime, and returns the DER
+// certificate.
+func writeCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "argocd-fleet-sync"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+	return der
+}
+
+func writeFile(t *testing.T, file string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Modification times are explicit, as consecutive writes may have the same one on coarse filesystems.
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	now := time.Now()
+	first := writeCert(t, certFile, keyFile, 1, now)
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader() failed: %v", err)
+	}
+	served := func() []byte {
+		t.Helper()
+		cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil || cert == nil {
+			t.Fatalf("GetCertificate() = %v, %v", cert, err)
+		}
+		return cert.Certificate[0]
+	}
+	if !bytes.Equal(served(), first) {
+		t.Error("GetCertificate() does not serve the loaded certificate")
+	}
+
+	// A renewed certificate is served once its files change.
+	second := writeCert(t, certFile, keyFile, 2, now.Add(time.Minute))
+	if !bytes.Equal(served(), second) {
+		t.Error("GetCertificate() does not serve the renewed certificate")
+	}
+
+	// Halfway through an update, eg. with a new certificate and the previous key, the last valid one is served.
+	writeCert(t, certFile, filepath.Join(dir, "other.key"), 3, now.Add(2*time.Minute))
+	if !bytes.Equal(served(), second) {
+		t.Error("GetCertificate() does not serve the last valid certificate while the files mismatch")
+	}
+	writeFile(t, certFile, []byte("not a certificate"), now.Add(3*time.Minute))
+	if !bytes.Equal(served(), second) {
+		t.Error("GetCertificate() does not serve the last valid certificate while the files are invalid")
+	}
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(served(), second) {
+		t.Error("GetCertificate() does not serve the last valid certificate while a file is missing")
+	}
+
+	// Once the update completes, the new certificate is served.
+	third := writeCert(t, certFile, keyFile, 4, now.Add(4*time.Minute))
+	if !bytes.Equal(served(), third) {
+		t.Error("GetCertificate() does not serve the certificate once the update completes")
+	}
+}
+
+func TestNewCertReloaderInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("newCertReloader() of missing files succeeded, want error")
+	}
+	writeFile(t, certFile, []byte("not a certificate"), time.Now())
+	writeFile(t, keyFile, []byte("not a key"), time.Now())
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("newCertReloader() of invalid files succeeded, want error")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSetupTracingDisabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		t.Fatalf("setupTracing() failed: %v", err)
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		t.Errorf("shutdownTracing() failed: %v", err)
+	}
+}
+
+// TestSetupTracing exports the spans of the plugin to a stand-in OTLP receiver. It sets the global TracerProvider,
+// so it is the only test of the package exporting spans.
+func TestSetupTracing(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies [][]byte
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("receiver got %s %s with Content-Type %q, want a POST of protobuf to /v1/traces", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer receiver.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", receiver.URL)
+	t.Setenv("OTEL_SERVICE_NAME", "")
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "")
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		t.Fatalf("setupTracing() failed: %v", err)
+	}
+	_, span := tracer.Start(context.Background(), "test-span")
+	span.End()
+	// Shutting down flushes the batched spans.
+	if err := shutdownTracing(context.Background()); err != nil {
+		t.Fatalf("shutdownTracing() failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	exported := bytes.Join(bodies, nil)
+	// The OTLP protobuf encodes the span name and the service name attribute as plain strings.
+	for _, want := range []string{"test-span", serviceName} {
+		if !bytes.Contains(exported, []byte(want)) {
+			t.Errorf("exported spans are missing %q", want)
+		}
+	}
+}